@@ -14,30 +14,98 @@ func GetCmd() *cobra.Command {
 		Use:          "locker [OPTIONS] COMMAND [ARG...]",
 		Short:        "Locker is a docker-like runtime for containers",
 		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return config.ReadConfigFile()
+		},
+	}
+
+	runCmd := &cobra.Command{
+		Use:   "run [OPTIONS] IMAGE|--rootfs DIR [COMMAND] [ARG...]",
+		Short: "Run a container",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return command.Run(args)
+		},
 	}
+	// flags following the image belong to the command of the container
+	runCmd.Flags().SetInterspersed(false)
+
+	imageCmd := &cobra.Command{
+		Use:   "image COMMAND",
+		Short: "Manage local images",
+	}
+	imageCmd.AddCommand(&cobra.Command{
+		Use:   "inspect [--format TEMPLATE] NAME[:TAG|@DIGEST]",
+		Short: "Show details of a local image",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return command.Inspect(args)
+		},
+	})
+	imageCmd.AddCommand(&cobra.Command{
+		Use:   "prune [--dry-run] [--max-size SIZE]",
+		Short: "Remove leftovers of crashed containers and unused layers, evict least recently used images over a size budget",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return command.Prune(args)
+		},
+	})
+
+	registryCmd := &cobra.Command{
+		Use:   "registry COMMAND",
+		Short: "Share local images with other hosts",
+	}
+	registryCmd.AddCommand(&cobra.Command{
+		Use:   "serve [--listen ADDR]",
+		Short: "Serve local images as a read-only registry",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return command.ServeRegistry(args)
+		},
+	})
 
 	cmdList := [](*cobra.Command){
+		runCmd,
+		imageCmd,
+		registryCmd,
 		&cobra.Command{
-			Use:   "run [OPTIONS] IMAGE [COMMAND] [ARG...]",
-			Short: "Run a container",
+			Use:   "pull [REGISTRY/]NAME[:TAG|@DIGEST] | --all [--update]",
+			Short: "Pull an image from a registry, or check local images for updates",
 			RunE: func(cmd *cobra.Command, args []string) error {
-				return command.Run(args)
+				return command.Pull(args)
 			},
 		},
 		&cobra.Command{
-			Use:   "pull NAME",
-			Short: "Pull an image from docker hub",
+			Use:   "push NAME[:TAG|@DIGEST] [[REGISTRY/]NAME[:TAG]]",
+			Short: "Push an image to a registry",
 			RunE: func(cmd *cobra.Command, args []string) error {
-				return command.Pull(args)
+				return command.Push(args)
 			},
 		},
 		&cobra.Command{
-			Use:   "rm NAME",
-			Short: "Remove an image locally",
+			Use:   "tag SOURCE[:TAG|@DIGEST] TARGET[:TAG]",
+			Short: "Add a name to a local image",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return command.Tag(args)
+			},
+		},
+		&cobra.Command{
+			Use:   "rm NAME[:TAG|@DIGEST]",
+			Short: "Remove a name of a local image, the image is removed with its last name",
 			RunE: func(cmd *cobra.Command, args []string) error {
 				return command.Remove(args)
 			},
 		},
+		&cobra.Command{
+			Use:   "login [REGISTRY]",
+			Short: "Log in to a registry, defaults to docker hub",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return command.Login(args)
+			},
+		},
+		&cobra.Command{
+			Use:   "logout [REGISTRY]",
+			Short: "Log out from a registry, defaults to docker hub",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return command.Logout(args)
+			},
+		},
 		&cobra.Command{
 			Use:   "ls",
 			Short: "List local images",
@@ -45,6 +113,48 @@ func GetCmd() *cobra.Command {
 				return command.Ls(args)
 			},
 		},
+		&cobra.Command{
+			Use:   "save [--oci] [-o FILE] NAME[:TAG|@DIGEST]...",
+			Short: "Save images to a tar archive (docker archive or OCI image layout)",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return command.Save(args)
+			},
+		},
+		&cobra.Command{
+			Use:   "load [-i FILE]",
+			Short: "Load images from a tar archive (docker archive or OCI image layout)",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return command.Load(args)
+			},
+		},
+		&cobra.Command{
+			Use:   "import [--change INSTRUCTION]... FILE|DIR|- NAME[:TAG]",
+			Short: "Create an image from a root file system tar archive or directory",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return command.Import(args)
+			},
+		},
+		&cobra.Command{
+			Use:   "commit [--change INSTRUCTION]... CONTAINER NAME[:TAG]",
+			Short: "Create an image from the changes of a container",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return command.Commit(args)
+			},
+		},
+		&cobra.Command{
+			Use:   "build [-f FILE] -t NAME[:TAG]... DIR",
+			Short: "Build an image from a Lockerfile",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return command.Build(args)
+			},
+		},
+		&cobra.Command{
+			Use:   "history NAME[:TAG|@DIGEST]",
+			Short: "Show the history of a local image",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return command.History(args)
+			},
+		},
 	}
 
 	for _, cmd := range cmdList {
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"os/exec"
 
 	"gitlab.com/amit-yuval/locker/internal/cli/command"
 	"gitlab.com/amit-yuval/locker/internal/signal"
@@ -12,7 +14,11 @@ func main() {
 	go signal.HandleSignals()
 	if utils.IsChild() {
 		if err := command.Child(); err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				os.Exit(exitErr.ExitCode())
+			}
 			fmt.Println("Error:", err)
+			os.Exit(1)
 		}
 	} else {
 		Execute(GetCmd())
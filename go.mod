@@ -5,9 +5,6 @@ go 1.14
 require (
 	code.cloudfoundry.org/bytefmt v0.0.0-20200131002437-cf55d5288a48
 	github.com/alexflint/go-filemutex v1.1.0
-	github.com/codeclysm/extract v2.2.0+incompatible
-	github.com/h2non/filetype v1.0.12 // indirect
-	github.com/juju/errors v0.0.0-20200330140219-3fe23663418f // indirect
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
 	github.com/pkg/errors v0.9.1
 	github.com/seccomp/libseccomp-golang v0.9.1
@@ -0,0 +1,181 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	lockerio "gitlab.com/amit-yuval/locker/pkg/io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+// dirTimes holds the times of a directory, set once all of its content is extracted
+type dirTimes struct {
+	path  string
+	atime time.Time
+	mtime time.Time
+}
+
+// Apply extracts a layer tar archive read from r into root
+// ownership, permissions, xattrs (including file capabilities), hardlinks, device nodes and times are restored,
+// whiteouts are converted to overlayfs form, and no entry is written outside of root
+func Apply(root string, r io.Reader) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return errors.Wrap(err, "invalid root directory")
+	}
+	var dirs []dirTimes
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "couldn't read tar entry")
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		path, err := lockerio.ScopedJoin(root, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return errors.Wrapf(err, "couldn't create parent directory of %s", hdr.Name)
+			}
+		}
+
+		if handled, err := applyWhiteout(root, path); err != nil {
+			return err
+		} else if handled {
+			continue
+		}
+		if err := createEntry(root, path, hdr, tr); err != nil {
+			return errors.Wrapf(err, "couldn't extract %s", hdr.Name)
+		}
+		if err := applyMetadata(path, hdr); err != nil {
+			return errors.Wrapf(err, "couldn't extract %s", hdr.Name)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{path: path, atime: hdr.AccessTime, mtime: hdr.ModTime})
+		}
+	}
+	// extracting content of a directory changes its times
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setTimes(dirs[i].path, dirs[i].atime, dirs[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createEntry creates the file system object of a tar entry at path, replacing an existing one
+func createEntry(root, path string, hdr *tar.Header, r io.Reader) error {
+	if fi, err := os.Lstat(path); err == nil {
+		// directories are merged, anything else is replaced
+		if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	case tar.TypeSymlink:
+		return os.Symlink(hdr.Linkname, path)
+	case tar.TypeLink:
+		target, err := lockerio.ScopedJoin(root, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(target, path)
+	case tar.TypeChar:
+		return unix.Mknod(path, unix.S_IFCHR|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+	case tar.TypeBlock:
+		return unix.Mknod(path, unix.S_IFBLK|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+	case tar.TypeFifo:
+		return unix.Mkfifo(path, mode)
+	default:
+		return errors.Errorf("unsupported tar entry type %q", hdr.Typeflag)
+	}
+	return nil
+}
+
+// applyMetadata restores ownership, permissions, xattrs and times of an extracted entry
+// ownership is set first, since chown clears setuid bits and file capabilities
+func applyMetadata(path string, hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeLink {
+		// shares the inode, and so the metadata, of its target
+		return nil
+	}
+	if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(path, os.FileMode(hdr.Mode&0777)|modeBits(hdr.Mode)); err != nil {
+			return err
+		}
+	}
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, paxXattrPrefix)
+		if err := unix.Lsetxattr(path, attr, []byte(value), 0); err != nil && err != unix.ENOTSUP {
+			return errors.Wrapf(err, "couldn't set xattr %s", attr)
+		}
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return setTimes(path, hdr.AccessTime, hdr.ModTime)
+}
+
+// modeBits converts setuid, setgid and sticky bits of a tar mode to os.FileMode
+func modeBits(mode int64) os.FileMode {
+	var m os.FileMode
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// setTimes sets access and modification times of path, without following symlinks
+func setTimes(path string, atime, mtime time.Time) error {
+	if atime.IsZero() {
+		atime = mtime
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return errors.Wrapf(err, "couldn't set times of %s", path)
+	}
+	return nil
+}
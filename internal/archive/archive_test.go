@@ -0,0 +1,151 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// entry is a tar entry of a test layer
+type entry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+}
+
+// layer returns a tar archive of entries
+func layer(t *testing.T, entries ...entry) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.content))}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// tempRoot returns a layer root inside a temporary directory, the directory is the parent of the root
+// so files written outside the root can be detected
+func tempRoot(t *testing.T) (string, string) {
+	if os.Geteuid() != 0 {
+		t.Skip("extracting layers requires root")
+	}
+	dir, err := ioutil.TempDir("", "apply-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir, root
+}
+
+func TestApply(t *testing.T) {
+	dir, root := tempRoot(t)
+	defer os.RemoveAll(dir)
+	err := Apply(root, layer(t,
+		entry{name: "etc/", typeflag: tar.TypeDir},
+		entry{name: "etc/hostname", typeflag: tar.TypeReg, content: "locker"},
+		entry{name: "etc/alias", typeflag: tar.TypeLink, linkname: "etc/hostname"},
+		entry{name: "etc/link", typeflag: tar.TypeSymlink, linkname: "hostname"},
+		entry{name: "usr/bin/.wh.rm", typeflag: tar.TypeReg},
+		entry{name: "opt/.wh..wh..opq", typeflag: tar.TypeReg},
+	))
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(root, "etc/alias")); err != nil || string(content) != "locker" {
+		t.Errorf("hardlink content = %q, %v, want %q", content, err, "locker")
+	}
+	if target, err := os.Readlink(filepath.Join(root, "etc/link")); err != nil || target != "hostname" {
+		t.Errorf("symlink target = %q, %v, want %q", target, err, "hostname")
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(filepath.Join(root, "usr/bin/rm"), &st); err != nil {
+		t.Errorf("whiteout wasn't created: %v", err)
+	} else if st.Mode&unix.S_IFMT != unix.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("whiteout has mode %o and device %d, want a 0/0 character device", st.Mode, st.Rdev)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "usr/bin/.wh.rm")); !os.IsNotExist(err) {
+		t.Error("whiteout file was extracted as is")
+	}
+}
+
+func TestApplyEscape(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []entry
+	}{
+		{"dot dot", []entry{{name: "../escaped", typeflag: tar.TypeReg, content: "x"}}},
+		{"absolute", []entry{{name: "/../escaped", typeflag: tar.TypeReg, content: "x"}}},
+		{"absolute symlink", []entry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "/"},
+			{name: "link/../escaped", typeflag: tar.TypeReg, content: "x"},
+		}},
+		{"relative symlink", []entry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "../"},
+			{name: "link/escaped", typeflag: tar.TypeReg, content: "x"},
+		}},
+		{"nested symlink", []entry{
+			{name: "a/", typeflag: tar.TypeDir},
+			{name: "a/link", typeflag: tar.TypeSymlink, linkname: "../../.."},
+			{name: "a/link/escaped", typeflag: tar.TypeReg, content: "x"},
+		}},
+		{"hardlink", []entry{
+			{name: "../escaped", typeflag: tar.TypeReg, content: "x"},
+			{name: "alias", typeflag: tar.TypeLink, linkname: "../../escaped"},
+		}},
+		{"whiteout through symlink", []entry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "/.."},
+			{name: "link/.wh.escaped", typeflag: tar.TypeReg},
+		}},
+	}
+	for _, test := range tests {
+		dir, root := tempRoot(t)
+		if err := Apply(root, layer(t, test.entries...)); err != nil {
+			t.Errorf("%s: Apply failed: %v", test.name, err)
+		}
+		if _, err := os.Lstat(filepath.Join(dir, "escaped")); err == nil {
+			t.Errorf("%s: entry was extracted outside of the root", test.name)
+		}
+		if _, err := os.Lstat(filepath.Join(root, "escaped")); err != nil {
+			t.Errorf("%s: entry wasn't extracted inside the root: %v", test.name, err)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestApplyHardlinkOutside(t *testing.T) {
+	dir, root := tempRoot(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Apply(root, layer(t, entry{name: "stolen", typeflag: tar.TypeLink, linkname: "../secret"})); err == nil {
+		t.Error("Apply of a hardlink to a file outside of the root succeeded")
+	}
+	if _, err := os.Lstat(filepath.Join(root, "stolen")); err == nil {
+		t.Error("hardlink to a file outside of the root was created")
+	}
+}
@@ -0,0 +1,246 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// overlayXattrPrefix prefixes xattrs overlayfs keeps its state in, which are not part of the content of a tree
+	overlayXattrPrefix   = "trusted.overlay."
+	overlayRedirectXattr = "trusted.overlay.redirect"
+)
+
+// fileID identifies an inode, to archive its hardlinks once
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// Owner is the ownership of archived files
+type Owner struct {
+	Uid int
+	Gid int
+}
+
+// Writer writes file system trees to a tar archive
+// ownership, permissions, xattrs (including file capabilities), hardlinks, device nodes and modification times are kept,
+// sockets can't be archived and are skipped
+type Writer struct {
+	tw    *tar.Writer
+	links map[fileID]string
+	// Overlay converts whiteouts and opaque directories of an overlayfs upper directory to their tar form
+	Overlay bool
+	// Exclude holds names of entries that are not archived, with their content
+	Exclude map[string]bool
+	// Owner replaces the ownership of archived files, if set
+	Owner *Owner
+}
+
+// NewWriter returns a Writer writing a tar archive to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{tw: tar.NewWriter(w), links: make(map[fileID]string)}
+}
+
+// Create writes the tree at root to w as a tar archive, entries are named relative to root, in lexical order
+func Create(w io.Writer, root string) error {
+	aw := NewWriter(w)
+	if err := aw.AddTree(root, ""); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// AddTree archives the content of directory src, named beneath name, in lexical order
+func (w *Writer) AddTree(src, name string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		entryName := path.Join(name, filepath.ToSlash(rel))
+		if w.Exclude[entryName] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return w.AddFile(p, entryName, info)
+	})
+}
+
+// AddFile archives the file at src, described by info, as name, a directory is archived without its content
+func (w *Writer) AddFile(src, name string, info os.FileInfo) error {
+	hdr, err := w.fileHeader(src, name, info)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't archive %s", name)
+	}
+	if hdr == nil {
+		return nil
+	}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "couldn't archive %s", name)
+	}
+	if info.IsDir() && w.Overlay {
+		if opaque, _ := getXattr(src, overlayOpaqueXattr); opaque == "y" {
+			// hides the content of the directory in lower layers
+			opq := &tar.Header{Typeflag: tar.TypeReg, Name: path.Join(name, whiteoutOpaque), ModTime: hdr.ModTime}
+			if err := w.tw.WriteHeader(opq); err != nil {
+				return errors.Wrapf(err, "couldn't archive %s", name)
+			}
+		}
+	}
+	if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+		return nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't archive %s", name)
+	}
+	defer f.Close()
+	if _, err := io.CopyN(w.tw, f, hdr.Size); err != nil {
+		return errors.Wrapf(err, "couldn't archive %s", name)
+	}
+	return nil
+}
+
+// AddEntry archives an entry described by hdr, with content read from r, the ownership of hdr is replaced if Owner is set
+func (w *Writer) AddEntry(hdr *tar.Header, r io.Reader) error {
+	if w.Owner != nil {
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = w.Owner.Uid, w.Owner.Gid, "", ""
+	}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "couldn't archive %s", hdr.Name)
+	}
+	if r == nil || hdr.Size == 0 {
+		return nil
+	}
+	if _, err := io.CopyN(w.tw, r, hdr.Size); err != nil {
+		return errors.Wrapf(err, "couldn't archive %s", hdr.Name)
+	}
+	return nil
+}
+
+// Close writes the end of the archive
+func (w *Writer) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return errors.Wrap(err, "couldn't write tar archive")
+	}
+	return nil
+}
+
+// fileHeader returns the tar header of the file at src, archived as name, nil if it can't be archived
+// further hardlinks of an inode are archived as links to the first one
+func (w *Writer) fileHeader(src, name string, info os.FileInfo) (*tar.Header, error) {
+	if info.Mode()&os.ModeSocket != 0 {
+		return nil, nil
+	}
+	st, _ := info.Sys().(*syscall.Stat_t)
+	if w.Overlay && st != nil && info.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0 {
+		// removes the file from lower layers
+		dir, base := path.Split(name)
+		return &tar.Header{Typeflag: tar.TypeReg, Name: dir + whiteoutPrefix + base, ModTime: info.ModTime()}, nil
+	}
+	if w.Overlay && info.IsDir() {
+		if redirect, _ := getXattr(src, overlayRedirectXattr); redirect != "" {
+			return nil, errors.New("renamed directories of an overlay can't be archived")
+		}
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(src); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	// names are looked up on the host, ids are what the tree uses
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	if st != nil {
+		hdr.Uid, hdr.Gid = int(st.Uid), int(st.Gid)
+		if info.Mode().IsRegular() && st.Nlink > 1 {
+			id := fileID{dev: uint64(st.Dev), ino: st.Ino}
+			if first, ok := w.links[id]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+				return hdr, nil
+			}
+			w.links[id] = name
+		}
+	}
+	if w.Owner != nil {
+		hdr.Uid, hdr.Gid = w.Owner.Uid, w.Owner.Gid
+	}
+	xattrs, err := readXattrs(src)
+	if err != nil {
+		return nil, err
+	}
+	for attr, value := range xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxXattrPrefix+attr] = value
+	}
+	return hdr, nil
+}
+
+// readXattrs returns the xattrs of path, without following symlinks, except those of overlayfs
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "couldn't list xattrs")
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, errors.Wrap(err, "couldn't list xattrs")
+	}
+	xattrs := make(map[string]string)
+	for _, attr := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if attr == "" || strings.HasPrefix(attr, overlayXattrPrefix) {
+			continue
+		}
+		value, err := getXattr(path, attr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read xattr %s", attr)
+		}
+		xattrs[attr] = value
+	}
+	return xattrs, nil
+}
+
+// getXattr returns the value of xattr attr of path, without following symlinks
+func getXattr(path, attr string) (string, error) {
+	size, err := unix.Lgetxattr(path, attr, nil)
+	if err != nil {
+		return "", err
+	}
+	value := make([]byte, size)
+	if size, err = unix.Lgetxattr(path, attr, value); err != nil {
+		return "", err
+	}
+	return string(value[:size]), nil
+}
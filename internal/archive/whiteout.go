@@ -0,0 +1,45 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	whiteoutPrefix     = ".wh."
+	whiteoutOpaque     = whiteoutPrefix + whiteoutPrefix + ".opq"
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+)
+
+// applyWhiteout converts a whiteout entry at path from its tar form to overlayfs form, returns false if path is not a whiteout
+// a whiteout file .wh.<name> becomes a 0/0 character device <name>,
+// an opaque whiteout .wh..wh..opq becomes the trusted.overlay.opaque xattr of its directory
+func applyWhiteout(root, path string) (bool, error) {
+	dir, name := filepath.Split(path)
+	if !strings.HasPrefix(name, whiteoutPrefix) {
+		return false, nil
+	}
+	if name == whiteoutOpaque {
+		if err := unix.Lsetxattr(dir, overlayOpaqueXattr, []byte("y"), 0); err != nil {
+			return true, errors.Wrapf(err, "couldn't mark directory %s opaque", strings.TrimPrefix(dir, root))
+		}
+		return true, nil
+	}
+	return true, whiteoutFile(filepath.Join(dir, strings.TrimPrefix(name, whiteoutPrefix)))
+}
+
+// whiteoutFile creates an overlayfs whiteout at path, hiding path of lower layers
+// whiteouts only apply to lower layers, a file of the same layer at path is kept
+func whiteoutFile(path string) error {
+	if _, err := os.Lstat(path); err == nil {
+		return nil
+	}
+	if err := unix.Mknod(path, unix.S_IFCHR, int(unix.Mkdev(0, 0))); err != nil {
+		return errors.Wrapf(err, "couldn't create whiteout %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package command
+
+import (
+	"os"
+
+	"gitlab.com/amit-yuval/locker/internal/image"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+)
+
+// Build builds an image from a Lockerfile, in the build context directory
+func Build(args []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("locker build needs to be executed as root")
+	}
+
+	if len(args) != 1 {
+		return errors.New("Usage: locker build [-f FILE] -t NAME[:TAG]... DIR")
+	}
+	opts := image.BuildOptions{
+		ContextDir: args[0],
+		Lockerfile: viper.GetString("file"),
+		Tags:       viper.GetStringSlice("tag"),
+		Output:     os.Stdout,
+		Pull:       viper.GetString("pull"),
+	}
+	if _, err := image.Build(opts, runBuildStep); err != nil {
+		return errors.Wrap(err, "couldn't build image")
+	}
+	return nil
+}
+
+// runBuildStep runs a RUN instruction of a build in a container, as the user and in the working directory of config
+func runBuildStep(c *image.ImageConfig, config *image.ContainerConfig, cmd []string) error {
+	if err := pflag.Set("workdir", config.WorkingDir); err != nil {
+		return err
+	}
+	if err := pflag.Set("user", config.User); err != nil {
+		return err
+	}
+	return runContainer(c, config, cmd, unix.SIGTERM)
+}
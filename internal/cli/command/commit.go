@@ -0,0 +1,33 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"gitlab.com/amit-yuval/locker/internal/image"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// Commit creates an image from the changes of a running container, or of a stopped one kept by locker run --rm=false
+func Commit(args []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("locker commit needs to be executed as root")
+	}
+
+	if len(args) != 2 {
+		return errors.New("Usage: locker commit [--change INSTRUCTION]... CONTAINER NAME[:TAG]")
+	}
+	// changes contain commas, which a string slice flag would split
+	changes, err := pflag.CommandLine.GetStringArray("change")
+	if err != nil {
+		return err
+	}
+	id, err := image.CommitContainer(args[0], args[1], changes)
+	if err != nil {
+		return errors.Wrap(err, "couldn't commit container")
+	}
+	fmt.Printf("Committed image %s (%s)\n", args[1], id)
+	return nil
+}
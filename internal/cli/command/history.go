@@ -0,0 +1,27 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"gitlab.com/amit-yuval/locker/internal/image"
+
+	"github.com/pkg/errors"
+)
+
+// History lists the layers of a local image and the steps that created them
+func History(args []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("locker history needs to be executed as root")
+	}
+
+	if len(args) != 1 {
+		return errors.New("Usage: locker history NAME[:TAG|@DIGEST]")
+	}
+	out, err := image.ImageHistory(args[0])
+	if err != nil {
+		return errors.Wrap(err, "couldn't get image history")
+	}
+	fmt.Print(out)
+	return nil
+}
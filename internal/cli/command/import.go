@@ -0,0 +1,33 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"gitlab.com/amit-yuval/locker/internal/image"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// Import creates an image from a root file system tar archive or directory, from stdin if the source is "-"
+func Import(args []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("locker import needs to be executed as root")
+	}
+
+	if len(args) != 2 {
+		return errors.New("Usage: locker import [--change INSTRUCTION]... FILE|DIR|- NAME[:TAG]")
+	}
+	// changes contain commas, which a string slice flag would split
+	changes, err := pflag.CommandLine.GetStringArray("change")
+	if err != nil {
+		return err
+	}
+	id, err := image.ImportImage(args[0], args[1], changes)
+	if err != nil {
+		return errors.Wrap(err, "couldn't import image")
+	}
+	fmt.Printf("Imported image %s (%s)\n", args[1], id)
+	return nil
+}
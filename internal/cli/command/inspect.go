@@ -0,0 +1,28 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"gitlab.com/amit-yuval/locker/internal/image"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Inspect prints details of a local image
+func Inspect(args []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("locker image inspect needs to be executed as root")
+	}
+
+	if len(args) != 1 {
+		return errors.New("Usage: locker image inspect [--format TEMPLATE] NAME[:TAG|@DIGEST]")
+	}
+	out, err := image.InspectImage(args[0], viper.GetString("format"))
+	if err != nil {
+		return errors.Wrap(err, "couldn't inspect image")
+	}
+	fmt.Print(out)
+	return nil
+}
@@ -0,0 +1,40 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"gitlab.com/amit-yuval/locker/internal/image"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Load loads images from a tar archive, from stdin if no input file is given
+func Load(args []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("locker load needs to be executed as root")
+	}
+
+	if len(args) != 0 {
+		return errors.New("Usage: locker load [-i FILE]")
+	}
+	var r io.Reader = os.Stdin
+	if input := viper.GetString("input"); input != "" && input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return errors.Wrap(err, "couldn't open archive")
+		}
+		defer f.Close()
+		r = f
+	}
+	names, err := image.LoadImages(r)
+	if err != nil {
+		return errors.Wrap(err, "couldn't load images")
+	}
+	for _, name := range names {
+		fmt.Printf("Loaded image: %s\n", name)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gitlab.com/amit-yuval/locker/internal/image"
+	"gitlab.com/amit-yuval/locker/pkg/io"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Login stores credentials of a registry
+func Login(args []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("locker login needs to be executed as root")
+	}
+	if len(args) > 1 {
+		return errors.New("Usage: locker login [REGISTRY]")
+	}
+	registry := ""
+	if len(args) == 1 {
+		registry = args[0]
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	username := viper.GetString("username")
+	if username == "" {
+		fmt.Print("Username: ")
+		line, err := stdin.ReadString('\n')
+		if err != nil {
+			return errors.Wrap(err, "couldn't read username")
+		}
+		username = strings.TrimSpace(line)
+	}
+
+	password := viper.GetString("password")
+	switch {
+	case viper.GetBool("password-stdin"):
+		data, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return errors.Wrap(err, "couldn't read password from stdin")
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	case password == "":
+		fmt.Print("Password: ")
+		line, err := io.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err != nil {
+			return errors.Wrap(err, "couldn't read password")
+		}
+		password = line
+	}
+	if username == "" || password == "" {
+		return errors.New("username and password are required")
+	}
+
+	if err := image.Login(registry, username, password); err != nil {
+		return err
+	}
+	fmt.Println("Login Succeeded")
+	return nil
+}
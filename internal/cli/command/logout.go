@@ -0,0 +1,24 @@
+package command
+
+import (
+	"os"
+
+	"gitlab.com/amit-yuval/locker/internal/image"
+
+	"github.com/pkg/errors"
+)
+
+// Logout removes stored credentials of a registry
+func Logout(args []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("locker logout needs to be executed as root")
+	}
+	if len(args) > 1 {
+		return errors.New("Usage: locker logout [REGISTRY]")
+	}
+	registry := ""
+	if len(args) == 1 {
+		registry = args[0]
+	}
+	return image.Logout(registry)
+}
@@ -0,0 +1,37 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"gitlab.com/amit-yuval/locker/internal/image"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Prune removes unused data of the image store
+func Prune(args []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("locker image prune needs to be executed as root")
+	}
+
+	if len(args) != 0 {
+		return errors.New("Usage: locker image prune [--dry-run] [--max-size SIZE]")
+	}
+	var maxSize int64
+	if viper.GetString("max-size") != "" {
+		size, err := bytefmt.ToBytes(viper.GetString("max-size"))
+		if err != nil {
+			return errors.Wrap(err, "invalid max-size")
+		}
+		maxSize = int64(size)
+	}
+	out, err := image.PruneImages(viper.GetBool("dry-run"), maxSize)
+	fmt.Print(out)
+	if err != nil {
+		return errors.Wrap(err, "couldn't prune images")
+	}
+	return nil
+}
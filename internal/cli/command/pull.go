@@ -6,16 +6,23 @@ import (
 	"gitlab.com/amit-yuval/locker/internal/image"
 
 	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 )
 
-// Pull pulls image
+// Pull pulls image, or checks all images for updates
 func Pull(args []string) error {
 	if os.Geteuid() != 0 {
 		return errors.New("locker pull needs to be executed as root")
 	}
 
+	if viper.GetBool("all") {
+		if len(args) != 0 {
+			return errors.New("Usage: locker pull --all [--update]")
+		}
+		return image.CheckImages(viper.GetBool("update"), os.Stdout)
+	}
 	if len(args) != 1 {
-		return errors.New("Usage: locker pull IMAGE")
+		return errors.New("Usage: locker pull [REGISTRY/]NAME[:TAG|@DIGEST]")
 	}
 	return image.PullImage(args[0])
 }
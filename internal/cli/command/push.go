@@ -0,0 +1,25 @@
+package command
+
+import (
+	"os"
+
+	"gitlab.com/amit-yuval/locker/internal/image"
+
+	"github.com/pkg/errors"
+)
+
+// Push pushes a local image to a registry, by its name or another one
+func Push(args []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("locker push needs to be executed as root")
+	}
+
+	if len(args) != 1 && len(args) != 2 {
+		return errors.New("Usage: locker push NAME[:TAG|@DIGEST] [[REGISTRY/]NAME[:TAG]]")
+	}
+	target := ""
+	if len(args) == 2 {
+		target = args[1]
+	}
+	return image.PushImage(args[0], target)
+}
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"fmt"
 	"os"
 
 	"gitlab.com/amit-yuval/locker/internal/image"
@@ -15,7 +16,9 @@ func Remove(args []string) error {
 	}
 
 	if len(args) != 1 {
-		return errors.New("Usage: locker remove IMAGE")
+		return errors.New("Usage: locker remove NAME[:TAG|@DIGEST]")
 	}
-	return image.RemoveImage(args[0])
+	report, err := image.RemoveImage(args[0])
+	fmt.Print(report)
+	return err
 }
@@ -2,9 +2,13 @@ package command
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"gitlab.com/amit-yuval/locker/internal/apparmor"
 	"gitlab.com/amit-yuval/locker/internal/caps"
@@ -15,6 +19,7 @@ import (
 	"gitlab.com/amit-yuval/locker/internal/mount"
 	"gitlab.com/amit-yuval/locker/internal/network"
 	"gitlab.com/amit-yuval/locker/internal/seccomp"
+	"gitlab.com/amit-yuval/locker/internal/signal"
 	"gitlab.com/amit-yuval/locker/internal/utils"
 
 	"github.com/pkg/errors"
@@ -28,8 +33,22 @@ func Run(args []string) error {
 	if os.Geteuid() != 0 {
 		return errors.New("locker run needs to be executed as root")
 	}
-	if len(args) < 1 {
-		return errors.New("Image not specified")
+	if viper.GetString("commit-on-exit") != "" {
+		layers, err := pflag.CommandLine.GetStringArray("layer")
+		if err != nil {
+			return err
+		}
+		if viper.GetString("rootfs") != "" || len(layers) > 0 {
+			return errors.New("--commit-on-exit can't commit --rootfs or --layer directories")
+		}
+	}
+	if viper.GetString("rootfs") == "" {
+		if viper.GetBool("in-place") {
+			return errors.New("--in-place requires --rootfs")
+		}
+		if len(args) < 1 {
+			return errors.New("Image not specified")
+		}
 	}
 	return parent(args)
 }
@@ -37,20 +56,54 @@ func Run(args []string) error {
 // parent function, forks and execs child, which runs the requested command
 func parent(args []string) error {
 	// mount image
-	imageConfig, err := image.MountImage(args[0])
+	imageConfig, containerConfig, args, err := mountRoot(args)
 	if err != nil {
 		return err
 	}
-	defer imageConfig.Cleanup()
-	mergedDir := filepath.Join(imageConfig.Dir, image.Merged)
+	defer func() {
+		if viper.GetBool("rm") {
+			imageConfig.Cleanup()
+			return
+		}
+		imageConfig.Stop()
+		fmt.Printf("Kept container %s\n", imageConfig.ID())
+	}()
 
-	cmdList, env, err := image.ReadConfigFile(args[0])
+	cmdList, err := containerConfig.Command(args)
 	if err != nil {
 		return err
 	}
-	env = environment.AppendEnv(env)
+	stopSignal, err := applyImageDefaults(containerConfig)
+	if err != nil {
+		return err
+	}
+	if err := imageConfig.MountVolumes(containerConfig.VolumePaths()); err != nil {
+		return err
+	}
+	err = runContainer(imageConfig, containerConfig, cmdList, stopSignal)
+	// changes are committed whatever the exit status of the command, e.g. of the last command of a shell
+	if _, exited := errors.Cause(err).(*exec.ExitError); (err == nil || exited) && viper.GetString("commit-on-exit") != "" {
+		name := viper.GetString("commit-on-exit")
+		id, commitErr := imageConfig.Commit(name, nil)
+		if commitErr != nil {
+			return errors.Wrap(commitErr, "couldn't commit container")
+		}
+		fmt.Printf("Committed image %s (%s)\n", name, id)
+	}
+	return err
+}
 
-	executablePath, err := utils.GetExecutablePath(cmdList[0], mergedDir, env)
+// runContainer runs cmdList in a container whose root file system is mounted in the directory of imageConfig,
+// stopped with stopSignal when locker is terminated, fails if the command fails
+func runContainer(imageConfig *image.ImageConfig, containerConfig *image.ContainerConfig, cmdList []string, stopSignal unix.Signal) error {
+	mergedDir := filepath.Join(imageConfig.Dir, image.Merged)
+	env := environment.AppendEnv(containerConfig.Env)
+
+	executable := cmdList[0]
+	if strings.Contains(executable, "/") && !filepath.IsAbs(executable) {
+		executable = filepath.Join(viper.GetString("workdir"), executable)
+	}
+	executablePath, err := utils.GetExecutablePath(executable, mergedDir, env)
 	if err != nil {
 		return err
 	}
@@ -64,7 +117,7 @@ func parent(args []string) error {
 	}
 
 	//command to fork exec self
-	cmd := exec.Command("/proc/self/exe", utils.GetChildArgs(args[0], mergedDir, cmdList)...)
+	cmd := exec.Command("/proc/self/exe", utils.GetChildArgs(mergedDir, cmdList)...)
 
 	//pipe streams
 	cmd.Stdin = os.Stdin
@@ -98,6 +151,10 @@ func parent(args []string) error {
 		return errors.Wrap(err, "couldn't start child")
 	}
 
+	// stop the container with its stop signal when locker is terminated
+	stopRelay := signal.Relay(func() int { return containerProcess(cmd.Process.Pid) }, stopSignal, unix.SIGTERM, unix.SIGHUP)
+	defer stopRelay()
+
 	if err := cgroups.RemoveSelf(); err != nil {
 		return err
 	}
@@ -109,10 +166,80 @@ func parent(args []string) error {
 	return nil
 }
 
+// mountRoot mounts the root file system of the container, the --rootfs directory or the image named by args[0],
+// with the --layer directories above it, returns it with the container config, and the arguments following the image
+func mountRoot(args []string) (*image.ImageConfig, *image.ContainerConfig, []string, error) {
+	// directories may contain commas, which a string slice flag would split
+	hostLayers, err := pflag.CommandLine.GetStringArray("layer")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if rootfs := viper.GetString("rootfs"); rootfs != "" {
+		imageConfig, err := image.MountRootfs(rootfs, viper.GetBool("in-place"), hostLayers)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return imageConfig, image.DefaultContainerConfig(), args, nil
+	}
+	imageConfig, err := image.MountImage(args[0], viper.GetString("pull"), hostLayers)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	containerConfig, err := image.ReadImageConfig(args[0])
+	if err != nil {
+		imageConfig.Cleanup()
+		return nil, nil, nil, err
+	}
+	return imageConfig, containerConfig, args[1:], nil
+}
+
+// applyImageDefaults sets the working directory, user and stop signal flags of the container
+// to the values of the image config, unless set explicitly, returns the stop signal
+func applyImageDefaults(c *image.ContainerConfig) (unix.Signal, error) {
+	defaults := map[string]string{
+		"workdir":     c.WorkingDir,
+		"user":        c.User,
+		"stop-signal": c.StopSignal,
+	}
+	for name, value := range defaults {
+		if !pflag.CommandLine.Changed(name) && value != "" {
+			if err := pflag.Set(name, value); err != nil {
+				return 0, errors.Wrapf(err, "invalid %s in image config", name)
+			}
+		}
+	}
+	if viper.GetString("stop-signal") == "" {
+		return unix.SIGTERM, nil
+	}
+	return signal.Parse(viper.GetString("stop-signal"))
+}
+
+// containerProcess returns the pid of the command process of the container, a child of the child process,
+// or the pid of the child process if the command isn't running
+// the command is signaled directly, since the child process can't create threads once its seccomp filter is loaded
+func containerProcess(childPid int) int {
+	children, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/task/%d/children", childPid, childPid))
+	if err != nil {
+		return childPid
+	}
+	fields := strings.Fields(string(children))
+	if len(fields) == 0 {
+		return childPid
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return childPid
+	}
+	return pid
+}
+
 // Child process, runs requested command
 func Child() error {
 
 	config.Init()
+	if err := config.ReadConfigFile(); err != nil {
+		return err
+	}
 	nonFlagArgs := pflag.Args()
 	baseDir, executable := nonFlagArgs[0], nonFlagArgs[1]
 
@@ -134,10 +261,32 @@ func Child() error {
 	if err := unix.Chroot("."); err != nil {
 		return errors.Wrap(err, "couldn't change root into container")
 	}
+	user, err := environment.LookupUser(viper.GetString("user"))
+	if err != nil {
+		return err
+	}
+	workDir := viper.GetString("workdir")
+	if workDir == "" {
+		workDir = "/"
+	}
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return errors.Wrap(err, "couldn't create working directory")
+	}
+	// relative executables are looked up from the working directory
+	if err := unix.Chdir(workDir); err != nil {
+		return errors.Wrap(err, "couldn't change into working directory")
+	}
 	cmd := exec.Command(executable, nonFlagArgs[2:]...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if os.Getenv("HOME") == "" {
+		cmd.Env = append(cmd.Env, "HOME="+user.Home)
+	}
+	cmd.SysProcAttr = &unix.SysProcAttr{
+		Credential: &syscall.Credential{Uid: user.Uid, Gid: user.Gid, Groups: user.Groups},
+	}
 
 	if err := mount.MountDefaults(); err != nil {
 		return err
@@ -153,7 +302,6 @@ func Child() error {
 	if err := caps.SetCaps(viper.GetStringSlice("caps")); err != nil {
 		return errors.Wrap(err, "couldn't set capabilities of child")
 	}
-	cmd.Run()
-
-	return nil
+	// the exit status of the command is the exit status of the child
+	return cmd.Run()
 }
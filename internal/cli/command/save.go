@@ -0,0 +1,52 @@
+package command
+
+import (
+	"os"
+	"path/filepath"
+
+	"gitlab.com/amit-yuval/locker/internal/image"
+	lockerio "gitlab.com/amit-yuval/locker/pkg/io"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Save writes local images to a tar archive, to stdout if no output file is given
+func Save(args []string) (err error) {
+	if os.Geteuid() != 0 {
+		return errors.New("locker save needs to be executed as root")
+	}
+
+	if len(args) < 1 {
+		return errors.New("Usage: locker save [--oci] [-o FILE] NAME[:TAG|@DIGEST]...")
+	}
+	output := viper.GetString("output")
+	if output == "" || output == "-" {
+		if lockerio.IsTerminal(int(os.Stdout.Fd())) {
+			return errors.New("refusing to write archive to a terminal, use -o FILE or redirect stdout")
+		}
+		return image.SaveImages(os.Stdout, args, viper.GetBool("oci"))
+	}
+
+	// the archive is written next to the output file, and replaces it once complete
+	f, err := os.Create(filepath.Join(filepath.Dir(output), "."+filepath.Base(output)+".tmp"))
+	if err != nil {
+		return errors.Wrap(err, "couldn't create archive")
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	err = image.SaveImages(f, args, viper.GetBool("oci"))
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "couldn't write archive")
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), output); err != nil {
+		return errors.Wrap(err, "couldn't write archive")
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package command
+
+import (
+	"os"
+
+	"gitlab.com/amit-yuval/locker/internal/image"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// ServeRegistry serves local images as a read-only registry
+func ServeRegistry(args []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("locker registry serve needs to be executed as root")
+	}
+
+	if len(args) != 0 {
+		return errors.New("Usage: locker registry serve [--listen ADDR]")
+	}
+	return image.ServeRegistry(viper.GetString("listen"))
+}
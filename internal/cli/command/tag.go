@@ -0,0 +1,21 @@
+package command
+
+import (
+	"os"
+
+	"gitlab.com/amit-yuval/locker/internal/image"
+
+	"github.com/pkg/errors"
+)
+
+// Tag adds a reference to a local image
+func Tag(args []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("locker tag needs to be executed as root")
+	}
+
+	if len(args) != 2 {
+		return errors.New("Usage: locker tag SOURCE[:TAG|@DIGEST] TARGET[:TAG]")
+	}
+	return image.TagImage(args[0], args[1])
+}
@@ -7,7 +7,17 @@ import (
 // parseArgs parses arguments
 func parseArgs() {
 	// generic
+	pflag.String("config", "/etc/locker/config.json", "Configuration file, a JSON object of flag values used unless given on the command line")
+	pflag.Bool("offline", false, "Fail instead of accessing the network (registries and ADD URLs)")
 	pflag.String("name", "locker", "Name of container (used in hostname and more)")
+	pflag.StringP("workdir", "w", "", "Working directory inside the container (defaults to the image working directory)")
+	pflag.String("user", "", "User to run as, user[:group] by name or id (defaults to the image user)")
+	pflag.String("stop-signal", "", "Signal to stop the container with (defaults to the image stop signal, or SIGTERM)")
+	pflag.String("rootfs", "", "Run a host directory as the root file system of the container instead of an image")
+	pflag.Bool("in-place", false, "Mount the --rootfs directory as is, the container changes it, instead of an overlay on it")
+	pflag.StringArray("layer", nil, "Host directory mounted read-only above the image layers (repeatable, the last one on top)")
+	pflag.Bool("rm", true, "Remove the container when it exits, --rm=false keeps it stopped for locker commit")
+	pflag.String("commit-on-exit", "", "Commit the changes of the container to image NAME[:TAG] when it exits")
 
 	// cgroups
 	pflag.String("memory-limit", "1GB", "RAM limit of container in bytes")
@@ -22,5 +32,39 @@ func parseArgs() {
 	pflag.StringSlice("cap-add", nil, "Add linux capabilities")
 	pflag.StringSlice("cap-drop", nil, "Drop linux capabilities")
 
+	// registry
+	pflag.StringSlice("insecure-registry", nil, "Registries to access over plain HTTP or without TLS verification")
+	pflag.StringSlice("registry-mirror", nil, "Mirror of a registry, tried before it, as REGISTRY=HOST[:PORT] (repeatable, tried in order)")
+	pflag.String("auth-file", "/etc/locker/auth.json", "Path of registry credentials file (docker config.json format)")
+	pflag.StringP("username", "u", "", "Registry username")
+	pflag.StringP("password", "p", "", "Registry password")
+	pflag.Bool("password-stdin", false, "Read registry password from stdin")
+	pflag.Int("max-concurrent-downloads", 3, "Maximum number of layers downloaded concurrently")
+	pflag.String("progress", "auto", "Pull progress output: auto, tty, plain or json")
+	pflag.String("pull", "missing", "Pull policy of run and build: missing, always (pull the image if its tag moved) or never")
+	pflag.Bool("all", false, "Check every local image pulled by tag against its registry, report outdated ones")
+	pflag.Bool("update", false, "Pull the outdated images locker pull --all finds, downloading only their changed layers")
+	pflag.String("listen", ":5000", "Address locker registry serve listens on, [HOST]:PORT")
+	pflag.String("platform", "", "Platform of image to pull, os/arch[/variant] (defaults to the host platform)")
+
+	// archives
+	pflag.StringP("output", "o", "", "Archive file locker save writes images to (defaults to stdout)")
+	pflag.StringP("input", "i", "", "Archive file locker load reads images from (defaults to stdin)")
+	pflag.Bool("oci", false, "Save images in the OCI image layout instead of the docker archive layout")
+	pflag.StringArray("change", nil, "Dockerfile instruction (ENV, CMD, ENTRYPOINT, WORKDIR, USER or LABEL) locker import or commit applies to the image")
+
+	// build
+	pflag.StringP("file", "f", "", "Lockerfile locker build reads (defaults to Lockerfile, or Dockerfile, in the build context)")
+	pflag.StringSliceP("tag", "t", nil, "Name of the image locker build creates, NAME[:TAG] (repeatable)")
+
+	// prune
+	pflag.Bool("dry-run", false, "Report what prune would remove without removing it")
+	pflag.String("max-size", "", "Size budget of prune, least recently used images are removed until local images fit in it (e.g. 10G)")
+
+	// output
+	pflag.String("format", "", "Format output of inspect using a Go template")
+
+	// arguments following the image are the command of the container
+	pflag.CommandLine.SetInterspersed(false)
 	pflag.Parse()
 }
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"os"
+
 	"gitlab.com/amit-yuval/locker/internal/caps"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -18,6 +21,22 @@ func Init() error {
 	return nil
 }
 
+// ReadConfigFile reads the config file, its keys are flag names, and its values are used for flags not given
+// on the command line, e.g. {"offline": true}, a missing config file is ignored
+// it is read once the command line is parsed, as the command line may name another config file
+func ReadConfigFile() error {
+	path := viper.GetString("config")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	viper.SetConfigFile(path)
+	viper.SetConfigType("json")
+	if err := viper.ReadInConfig(); err != nil {
+		return errors.Wrapf(err, "couldn't read config file %s", path)
+	}
+	return nil
+}
+
 // setModifiedFlags sets flags at runtime
 func setModifiedFlags() error {
 	capList, err := caps.GetCapsList()
@@ -0,0 +1,143 @@
+package environment
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"gitlab.com/amit-yuval/locker/pkg/io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	passwdFile = "/etc/passwd"
+	groupFile  = "/etc/group"
+)
+
+// User holds the credentials of a user of the container
+type User struct {
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32 // supplementary groups
+	Home   string
+}
+
+// LookupUser resolves user spec (user[:group], by name or id) with the passwd and group files of the current root
+// an empty spec is root, numeric ids missing from the passwd file are allowed
+func LookupUser(spec string) (*User, error) {
+	return LookupUserIn("/", spec)
+}
+
+// LookupUserIn resolves user spec as LookupUser does, with the passwd and group files of the tree at root
+func LookupUserIn(root, spec string) (*User, error) {
+	userSpec, groupSpec := spec, ""
+	if i := strings.Index(spec, ":"); i != -1 {
+		userSpec, groupSpec = spec[:i], spec[i+1:]
+	}
+	if userSpec == "" {
+		userSpec = "0"
+	}
+	passwdPath, err := io.ScopedJoin(root, passwdFile)
+	if err != nil {
+		return nil, err
+	}
+	groupPath, err := io.ScopedJoin(root, groupFile)
+	if err != nil {
+		return nil, err
+	}
+	passwd, err := readColonFile(passwdPath)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := readColonFile(groupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &User{Home: "/"}
+	name := ""
+	uid, numeric := parseId(userSpec)
+	found := false
+	for _, entry := range passwd {
+		if len(entry) < 6 {
+			continue
+		}
+		entryUid, ok := parseId(entry[2])
+		if !ok || !(entry[0] == userSpec || (numeric && entryUid == uid)) {
+			continue
+		}
+		entryGid, _ := parseId(entry[3])
+		name, u.Uid, u.Gid, u.Home = entry[0], entryUid, entryGid, entry[5]
+		found = true
+		break
+	}
+	if !found {
+		if !numeric {
+			return nil, errors.Errorf("user %s not found in container", userSpec)
+		}
+		u.Uid, u.Gid = uid, uid
+		if uid == 0 {
+			u.Home = "/root"
+		}
+	}
+
+	if groupSpec != "" {
+		gid, numeric := parseId(groupSpec)
+		found := numeric
+		for _, entry := range groups {
+			if len(entry) >= 3 && entry[0] == groupSpec {
+				gid, found = parseId(entry[2])
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("group %s not found in container", groupSpec)
+		}
+		u.Gid = gid
+	} else if name != "" {
+		// supplementary groups apply only if the primary group wasn't set explicitly
+		for _, entry := range groups {
+			if len(entry) < 4 {
+				continue
+			}
+			for _, member := range strings.Split(entry[3], ",") {
+				if gid, ok := parseId(entry[2]); ok && member == name && gid != u.Gid {
+					u.Groups = append(u.Groups, gid)
+				}
+			}
+		}
+	}
+	return u, nil
+}
+
+// parseId parses a numeric user or group id
+func parseId(s string) (uint32, bool) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err == nil
+}
+
+// readColonFile reads a colon separated file such as /etc/passwd, a missing file has no entries
+func readColonFile(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "couldn't open %s", path)
+	}
+	defer f.Close()
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "couldn't read %s", path)
+	}
+	return entries, nil
+}
@@ -0,0 +1,185 @@
+package image
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// dockerHubAuthKey is the key docker stores docker hub credentials under
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// authEntry holds credentials of a single registry, in the format of the docker config.json "auths" section
+type authEntry struct {
+	Auth     string `json:"auth,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// credentials returns username and password of entry
+func (e *authEntry) credentials() (string, string, error) {
+	if e.Auth == "" {
+		return e.Username, e.Password, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(e.Auth)
+	if err != nil {
+		return "", "", errors.Wrap(err, "couldn't decode registry credentials")
+	}
+	split := strings.SplitN(string(decoded), ":", 2)
+	if len(split) != 2 {
+		return "", "", errors.New("invalid registry credentials format")
+	}
+	return split[0], split[1], nil
+}
+
+// authKey returns the key under which credentials for registry are stored
+func authKey(registry string) string {
+	if registry == defaultRegistry {
+		return dockerHubAuthKey
+	}
+	return registry
+}
+
+// normalizeAuthKey strips scheme and path of a stored key, so "https://host/v2/" matches "host"
+func normalizeAuthKey(key string) string {
+	if key == dockerHubAuthKey {
+		return defaultRegistry
+	}
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key = strings.Split(key, "/")[0]
+	switch key {
+	case "index.docker.io", defaultRegistryHost:
+		return defaultRegistry
+	}
+	return key
+}
+
+// readAuthFile returns the content of the auth file, and its parsed "auths" section
+func readAuthFile() (map[string]json.RawMessage, map[string]authEntry, error) {
+	content := make(map[string]json.RawMessage)
+	auths := make(map[string]authEntry)
+	data, err := ioutil.ReadFile(viper.GetString("auth-file"))
+	if os.IsNotExist(err) {
+		return content, auths, nil
+	} else if err != nil {
+		return nil, nil, errors.Wrap(err, "couldn't read auth file")
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, nil, errors.Wrap(err, "couldn't parse auth file")
+	}
+	if raw, ok := content["auths"]; ok {
+		if err := json.Unmarshal(raw, &auths); err != nil {
+			return nil, nil, errors.Wrap(err, "couldn't parse auths of auth file")
+		}
+	}
+	return content, auths, nil
+}
+
+// writeAuthFile writes auths to the auth file, keeps other content of the file intact
+func writeAuthFile(content map[string]json.RawMessage, auths map[string]authEntry) error {
+	raw, err := json.Marshal(auths)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal auths")
+	}
+	content["auths"] = raw
+	data, err := json.MarshalIndent(content, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal auth file")
+	}
+
+	path := viper.GetString("auth-file")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "couldn't create auth file directory")
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".auth-")
+	if err != nil {
+		return errors.Wrap(err, "couldn't create temporary auth file")
+	}
+	defer os.Remove(tmpFile.Name())
+	// credentials are readable by root only
+	if err := tmpFile.Chmod(0600); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "couldn't set permissions of auth file")
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "couldn't write auth file")
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.Wrap(err, "couldn't write auth file")
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// getCredentials returns stored username and password for registry, empty if none are stored
+func getCredentials(registry string) (string, string, error) {
+	_, auths, err := readAuthFile()
+	if err != nil {
+		return "", "", err
+	}
+	for key, entry := range auths {
+		if normalizeAuthKey(key) == registry {
+			return entry.credentials()
+		}
+	}
+	return "", "", nil
+}
+
+// Login verifies given credentials against registry, and stores them in the auth file
+// registry may be given with a scheme or a path, as in the keys of the auth file (e.g. https://host:5000/v2/)
+func Login(registry, username, password string) error {
+	registry = normalizeAuthKey(registry)
+	if registry == "" {
+		registry = defaultRegistry
+	}
+	if !hostRegexp.MatchString(registry) {
+		return errors.Errorf("invalid registry %q", registry)
+	}
+	ref := &Reference{Registry: registry}
+	if _, err := newAuthenticatedClient(ref, "", "", username, password); err != nil {
+		return errors.Wrapf(err, "login to %s failed", registry)
+	}
+
+	content, auths, err := readAuthFile()
+	if err != nil {
+		return err
+	}
+	for key := range auths {
+		if normalizeAuthKey(key) == registry {
+			delete(auths, key)
+		}
+	}
+	auths[authKey(registry)] = authEntry{
+		Auth: base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+	}
+	return writeAuthFile(content, auths)
+}
+
+// Logout removes stored credentials of registry, given as to Login
+func Logout(registry string) error {
+	registry = normalizeAuthKey(registry)
+	if registry == "" {
+		registry = defaultRegistry
+	}
+	content, auths, err := readAuthFile()
+	if err != nil {
+		return err
+	}
+	found := false
+	for key := range auths {
+		if normalizeAuthKey(key) == registry {
+			delete(auths, key)
+			found = true
+		}
+	}
+	if !found {
+		return errors.Errorf("not logged in to %s", registry)
+	}
+	return writeAuthFile(content, auths)
+}
@@ -0,0 +1,71 @@
+package image
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestNormalizeAuthKey(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"", ""},
+		{dockerHubAuthKey, defaultRegistry},
+		{"docker.io", defaultRegistry},
+		{"index.docker.io", defaultRegistry},
+		{"registry-1.docker.io", defaultRegistry},
+		{"host:5000", "host:5000"},
+		{"host:5000/", "host:5000"},
+		{"http://host:5000", "host:5000"},
+		{"https://host:5000/v2/", "host:5000"},
+	}
+	for _, test := range tests {
+		if got := normalizeAuthKey(test.key); got != test.want {
+			t.Errorf("normalizeAuthKey(%q) = %q, want %q", test.key, got, test.want)
+		}
+	}
+}
+
+func TestLoginLogout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set("auth-file", filepath.Join(dir, "auth.json"))
+	defer viper.Set("auth-file", nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "secret" {
+			w.Header().Set("Www-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	for _, registry := range []string{host, host + "/", "http://" + host, "https://" + host + "/v2/"} {
+		if err := Login(registry, "user", "secret"); err != nil {
+			t.Errorf("Login(%q) failed: %v", registry, err)
+			continue
+		}
+		if username, password, err := getCredentials(host); err != nil || username != "user" || password != "secret" {
+			t.Errorf("credentials stored by Login(%q) = %q, %q, %v", registry, username, password, err)
+		}
+		if err := Logout(registry); err != nil {
+			t.Errorf("Logout(%q) failed: %v", registry, err)
+		}
+		if username, _, _ := getCredentials(host); username != "" {
+			t.Errorf("Logout(%q) kept credentials of %s", registry, username)
+		}
+	}
+	if err := Login("bad_host", "user", "secret"); err == nil {
+		t.Error("Login to an invalid registry succeeded")
+	}
+}
@@ -0,0 +1,832 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/amit-yuval/locker/internal/archive"
+	"gitlab.com/amit-yuval/locker/internal/environment"
+	lockerio "gitlab.com/amit-yuval/locker/pkg/io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// runtimeFiles are files the container runtime writes to the root file system of a container,
+// which are not part of the layers created from its changes
+var runtimeFiles = map[string]bool{
+	"etc/resolv.conf": true,
+	"etc/ld.so.cache": true,
+}
+
+// BuildOptions configures a build
+type BuildOptions struct {
+	ContextDir string    // directory COPY and ADD read files from
+	Lockerfile string    // defaults to Lockerfile, or Dockerfile, in ContextDir
+	Tags       []string  // references the image is stored by
+	Output     io.Writer // progress output
+	Pull       string    // pull policy of the images stages start from
+}
+
+// RunFunc runs command cmd in a container configured by config, whose root file system is mounted in the directory of c
+type RunFunc func(c *ImageConfig, config *ContainerConfig, cmd []string) error
+
+// buildStage is a stage of a build, the image it built so far
+type buildStage struct {
+	name      string
+	oci       bool         // layers are described by an OCI manifest
+	layers    []descriptor // layer blobs, from the base layer up
+	layerDirs []string
+	config    *imageConfigFile
+}
+
+// builder builds an image from the instructions of a Lockerfile
+type builder struct {
+	opts   BuildOptions
+	run    RunFunc
+	stages []*buildStage
+	stage  *buildStage // the stage instructions apply to
+	tmpDir string      // downloads and mount points of the build
+}
+
+// Build builds an image from a Lockerfile and stores it by the tags of opts, returns its image ID
+// each RUN instruction runs in a container, with run, and its changes become a layer of the image
+// layers of RUN instructions are cached by their command, and the config and layers they run on,
+// layers of COPY and ADD instructions are reused if their content exists
+// FROM IMAGE AS NAME starts a stage, later stages start from it or copy files from it with COPY --from=NAME
+func Build(opts BuildOptions, run RunFunc) (string, error) {
+	if len(opts.Tags) == 0 {
+		return "", errors.New("no tag given for the image")
+	}
+	var refs []*Reference
+	for _, tag := range opts.Tags {
+		ref, err := ParseReference(tag)
+		if err != nil {
+			return "", err
+		}
+		if ref.Digest != "" {
+			return "", errors.Errorf("can't tag image %s by digest", ref)
+		}
+		refs = append(refs, ref)
+	}
+	contextDir, err := filepath.Abs(opts.ContextDir)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid build context")
+	}
+	if info, err := os.Stat(contextDir); err != nil {
+		return "", errors.Wrap(err, "invalid build context")
+	} else if !info.IsDir() {
+		return "", errors.Errorf("build context %s is not a directory", opts.ContextDir)
+	}
+	opts.ContextDir = contextDir
+	if opts.Lockerfile == "" {
+		opts.Lockerfile = filepath.Join(contextDir, "Lockerfile")
+		if _, err := os.Stat(opts.Lockerfile); os.IsNotExist(err) {
+			opts.Lockerfile = filepath.Join(contextDir, "Dockerfile")
+		}
+	}
+	f, err := os.Open(opts.Lockerfile)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't open Lockerfile")
+	}
+	instructions, err := parseLockerfile(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if len(instructions) == 0 || instructions[0].cmd != "FROM" {
+		return "", errors.New("Lockerfile must start with FROM")
+	}
+
+	// pulls and builds create layers and blobs before they are recorded in the store
+	unlockPulls, err := lockPulls(false)
+	if err != nil {
+		return "", err
+	}
+	defer unlockPulls()
+	tmpDir, err := ioutil.TempDir(imagesDir, ".build-")
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't create build directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	b := &builder{opts: opts, run: run, tmpDir: tmpDir}
+	for i, instruction := range instructions {
+		fmt.Fprintf(opts.Output, "Step %d/%d : %s\n", i+1, len(instructions), instruction.text)
+		if err := b.step(instruction); err != nil {
+			return "", errors.Wrapf(err, "line %d", instruction.line)
+		}
+	}
+	return b.commit(refs)
+}
+
+// step applies an instruction to the current stage, FROM starts a new stage
+func (b *builder) step(instruction *lockerfileInstruction) error {
+	switch instruction.cmd {
+	case "FROM":
+		return b.from(instruction)
+	case "RUN":
+		return b.runStep(instruction)
+	case "COPY", "ADD":
+		return b.copyStep(instruction)
+	}
+	args := instruction.args
+	if instruction.cmd != "CMD" && instruction.cmd != "ENTRYPOINT" {
+		args = b.expand(args)
+	}
+	if err := b.stage.config.Config.applyChange(instruction.cmd + " " + args); err != nil {
+		return err
+	}
+	b.stage.config.History = append(b.stage.config.History, historyEntry{
+		Created:    time.Now().UTC(),
+		CreatedBy:  instruction.text,
+		EmptyLayer: true,
+	})
+	return nil
+}
+
+// expand replaces $VAR and ${VAR} in s with environment variables of the current stage
+func (b *builder) expand(s string) string {
+	return os.Expand(s, func(key string) string {
+		for _, env := range b.stage.config.Config.Env {
+			if kv := strings.SplitN(env, "=", 2); len(kv) == 2 && kv[0] == key {
+				return kv[1]
+			}
+		}
+		return ""
+	})
+}
+
+// from starts a stage, from an image, a previous stage or scratch
+func (b *builder) from(instruction *lockerfileInstruction) error {
+	words := strings.Fields(instruction.args)
+	name := ""
+	if len(words) == 3 && strings.EqualFold(words[1], "AS") {
+		name = strings.ToLower(words[2])
+	} else if len(words) != 1 {
+		return errors.New("FROM takes IMAGE [AS NAME]")
+	}
+	stage, err := b.baseStage(words[0])
+	if err != nil {
+		return err
+	}
+	stage.name = name
+	b.stages = append(b.stages, stage)
+	b.stage = stage
+	return nil
+}
+
+// findStage returns a previous stage by name or index, nil if there is none
+func (b *builder) findStage(name string) *buildStage {
+	if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(b.stages) {
+		return b.stages[i]
+	}
+	for _, stage := range b.stages {
+		if stage.name != "" && stage.name == strings.ToLower(name) {
+			return stage
+		}
+	}
+	return nil
+}
+
+// baseStage returns a new stage starting from a previous stage, an image (pulled if not found locally) or scratch
+func (b *builder) baseStage(name string) (*buildStage, error) {
+	if stage := b.findStage(name); stage != nil {
+		return stage.clone()
+	}
+	if name == "scratch" {
+		config := &imageConfigFile{platform: hostPlatform()}
+		config.RootFS.Type = "layers"
+		return &buildStage{config: config}, nil
+	}
+	ref, err := ParseReference(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureImage(ref, b.opts.Pull, b.opts.Output); err != nil {
+		return nil, err
+	}
+	store, err := readStore()
+	if err != nil {
+		return nil, err
+	}
+	record, ok := store.get(ref)
+	if !ok {
+		return nil, errors.Errorf("image %s not found", ref)
+	}
+	return imageStage(ref, record)
+}
+
+// imageStage returns a stage starting from the image of record
+func imageStage(ref *Reference, record *imageRecord) (*buildStage, error) {
+	if record.ManifestDigest == "" {
+		return nil, errors.Errorf("image %s has no stored manifest, pull it again", ref)
+	}
+	m, err := readManifestBlob(record.ManifestDigest)
+	if err != nil {
+		return nil, err
+	}
+	config, err := record.config()
+	if err != nil {
+		return nil, err
+	}
+	layerDirs, err := record.layerDirs()
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Layers) != len(layerDirs) {
+		return nil, errors.Errorf("image config of %s doesn't match its manifest", ref)
+	}
+	return &buildStage{oci: m.MediaType == mediaTypeOCIManifest, layers: m.Layers, layerDirs: layerDirs, config: config}, nil
+}
+
+// clone returns a copy of the stage, which changes independently of it
+func (s *buildStage) clone() (*buildStage, error) {
+	data, err := json.Marshal(s.config)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't marshal image config")
+	}
+	var config imageConfigFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse image config")
+	}
+	return &buildStage{
+		oci:       s.oci,
+		layers:    append([]descriptor{}, s.layers...),
+		layerDirs: append([]string{}, s.layerDirs...),
+		config:    &config,
+	}, nil
+}
+
+// addLayer adds a layer to the current stage, with its history entry
+func (b *builder) addLayer(history historyEntry, layer descriptor, diffID string) error {
+	layerDir, err := layerPath(diffID)
+	if err != nil {
+		return err
+	}
+	s := b.stage
+	s.layers = append(s.layers, layer)
+	s.layerDirs = append(s.layerDirs, layerDir)
+	s.config.RootFS.DiffIDs = append(s.config.RootFS.DiffIDs, diffID)
+	history.Created = time.Now().UTC()
+	s.config.History = append(s.config.History, history)
+	fmt.Fprintf(b.opts.Output, " ---> %s\n", layerID(diffID))
+	return nil
+}
+
+// runStep runs the command of a RUN instruction in a container of the current stage, its changes become a layer
+func (b *builder) runStep(instruction *lockerfileInstruction) error {
+	cmd := parseCommand(instruction.args)
+	config := b.stage.config.Config
+	config.setDefaults()
+	key, err := b.cacheKey(&config, cmd)
+	if err != nil {
+		return err
+	}
+	if entry := cachedLayer(key); entry != nil {
+		fmt.Fprintln(b.opts.Output, " ---> Using cache")
+		entry.Layer.MediaType = layerMediaType(gzipCompressed, b.stage.oci)
+		return b.addLayer(historyEntry{CreatedBy: instruction.text}, entry.Layer, entry.DiffID)
+	}
+	layer, diffID, err := b.runContainer(&config, cmd)
+	if err != nil {
+		return err
+	}
+	err = updateStore(func(s *imageStore) error {
+		if s.BuildCache == nil {
+			s.BuildCache = make(map[string]*buildCacheEntry)
+		}
+		s.BuildCache[key] = &buildCacheEntry{DiffID: diffID, Layer: layer, Created: time.Now().UTC()}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return b.addLayer(historyEntry{CreatedBy: instruction.text}, layer, diffID)
+}
+
+// cacheKey returns the build cache key of running cmd with config, on the layers of the current stage
+func (b *builder) cacheKey(config *ContainerConfig, cmd []string) (string, error) {
+	data, err := json.Marshal(struct {
+		DiffIDs []string         `json:"diffIDs"`
+		Config  *ContainerConfig `json:"config"`
+		Cmd     []string         `json:"cmd"`
+	}{b.stage.config.RootFS.DiffIDs, config, cmd})
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't marshal build cache key")
+	}
+	return digestBytes(data), nil
+}
+
+// cachedLayer returns the build cache entry of key, nil if there is none or its layer was removed
+func cachedLayer(key string) *buildCacheEntry {
+	store, err := readStore()
+	if err != nil {
+		return nil
+	}
+	entry, ok := store.BuildCache[key]
+	if !ok {
+		return nil
+	}
+	layerDir, err := layerPath(entry.DiffID)
+	if err != nil {
+		return nil
+	}
+	blob, err := blobPath(entry.Layer.Digest)
+	if err != nil {
+		return nil
+	}
+	for _, p := range []string{layerDir, blob} {
+		if _, err := os.Stat(p); err != nil {
+			return nil
+		}
+	}
+	return entry
+}
+
+// runContainer runs cmd in a container of the current stage, returns the layer of its changes
+func (b *builder) runContainer(config *ContainerConfig, cmd []string) (descriptor, string, error) {
+	c, err := createContainerDir(containerRecord{})
+	if err != nil {
+		return descriptor{}, "", err
+	}
+	defer c.Cleanup()
+	if err := createOverlayDirs(c.Dir); err != nil {
+		return descriptor{}, "", err
+	}
+	lowerDirs := b.stage.layerDirs
+	if len(lowerDirs) == 0 {
+		// overlayfs needs a lower directory
+		empty := filepath.Join(c.Dir, "empty")
+		if err := os.Mkdir(empty, 0755); err != nil {
+			return descriptor{}, "", errors.Wrap(err, "couldn't create empty layer")
+		}
+		lowerDirs = []string{empty}
+	}
+	if err := mountLayers(c.Dir, lowerDirs); err != nil {
+		return descriptor{}, "", err
+	}
+	fmt.Fprintf(b.opts.Output, " ---> Running in %s\n", filepath.Base(c.Dir))
+	if err := b.run(c, config, cmd); err != nil {
+		return descriptor{}, "", errors.Wrapf(err, "command %q failed", strings.Join(cmd, " "))
+	}
+	if err := unix.Unmount(filepath.Join(c.Dir, Merged), 0); err != nil {
+		return descriptor{}, "", errors.Wrap(err, "couldn't unmount container")
+	}
+	return b.createLayer(func(w *archive.Writer) error {
+		w.Overlay, w.Exclude = true, runtimeFiles
+		return w.AddTree(filepath.Join(c.Dir, upper), "")
+	})
+}
+
+// createLayer stores the tar archive written by write as a layer of the current stage,
+// returns its blob descriptor and diff ID, a layer that already exists is reused
+func (b *builder) createLayer(write func(w *archive.Writer) error) (descriptor, string, error) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		w := archive.NewWriter(pw)
+		err := write(w)
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	var created []string
+	layer, diffID, err := createLayerBlob(pr, &created)
+	if err != nil {
+		return layer, "", err
+	}
+	layer.MediaType = layerMediaType(gzipCompressed, b.stage.oci)
+	layerDir, err := layerPath(diffID)
+	if err != nil {
+		return layer, "", err
+	}
+	if _, err := os.Stat(layerDir); err == nil {
+		fmt.Fprintln(b.opts.Output, " ---> Using cache")
+		return layer, diffID, nil
+	}
+	blob, err := blobPath(layer.Digest)
+	if err != nil {
+		return layer, "", err
+	}
+	if _, err := unpackLayer(blob, layer.MediaType, diffID); err != nil {
+		removeCreated(created)
+		return layer, "", err
+	}
+	return layer, diffID, nil
+}
+
+// mountStage mounts the root file system of a stage read-only, returns its directory and a function unmounting it
+func (b *builder) mountStage(s *buildStage) (string, func(), error) {
+	if len(s.layerDirs) == 1 {
+		return s.layerDirs[0], func() {}, nil
+	}
+	dir, err := ioutil.TempDir(b.tmpDir, "root-")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "couldn't create mount point")
+	}
+	if len(s.layerDirs) == 0 {
+		return dir, func() {}, nil
+	}
+	// overlayfs stacks lower directories from right to left, the top layer comes first
+	lowerDirs := make([]string, len(s.layerDirs))
+	for i, layer := range s.layerDirs {
+		lowerDirs[len(s.layerDirs)-1-i] = layer
+	}
+	if err := unix.Mount("overlay", dir, "overlay", unix.MS_RDONLY, "lowerdir="+strings.Join(lowerDirs, ":")); err != nil {
+		return "", nil, errors.Wrap(err, "unable to mount stage")
+	}
+	return dir, func() { unix.Unmount(dir, 0) }, nil
+}
+
+// copySource is a file COPY or ADD archives
+type copySource struct {
+	path string // path on the host
+	name string // base name in the image
+	info os.FileInfo
+	url  bool // downloaded by ADD
+}
+
+// copyStep creates a layer of the files a COPY or ADD instruction copies from the build context, or another stage
+// ADD extracts local tar archives, and downloads URLs
+func (b *builder) copyStep(instruction *lockerfileInstruction) error {
+	args := b.expand(instruction.args)
+	var words []string
+	if strings.HasPrefix(args, "[") {
+		if err := json.Unmarshal([]byte(args), &words); err != nil {
+			return errors.Wrapf(err, "invalid %s arguments", instruction.cmd)
+		}
+	} else {
+		var err error
+		if words, err = splitWords(args); err != nil {
+			return err
+		}
+	}
+	if len(words) < 2 {
+		return errors.Errorf("%s needs a source and a destination", instruction.cmd)
+	}
+	srcs, dest := words[:len(words)-1], words[len(words)-1]
+	add := instruction.cmd == "ADD"
+
+	srcRoot := b.opts.ContextDir
+	if from := instruction.flags["from"]; from != "" {
+		stage := b.findStage(from)
+		if stage == nil {
+			var err error
+			if stage, err = b.baseStage(from); err != nil {
+				return err
+			}
+		}
+		root, unmount, err := b.mountStage(stage)
+		if err != nil {
+			return err
+		}
+		defer unmount()
+		srcRoot = root
+	}
+	root, unmount, err := b.mountStage(b.stage)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+
+	var sources []copySource
+	for _, src := range srcs {
+		matched, err := b.copySources(srcRoot, src, add)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, matched...)
+	}
+	// a destination ending with / or . is a directory
+	destDir := strings.HasSuffix(dest, "/") || path.Base(dest) == "." || path.Base(dest) == ".."
+	if len(srcs) > 1 && !destDir {
+		return errors.Errorf("destination %s of several sources must end with /", dest)
+	}
+	destDir = destDir || len(sources) > 1
+	if !path.IsAbs(dest) {
+		dest = path.Join("/", b.stage.config.Config.WorkingDir, dest)
+	}
+	var owner *archive.Owner
+	if chown := instruction.flags["chown"]; chown != "" {
+		u, err := environment.LookupUserIn(root, chown)
+		if err != nil {
+			return err
+		}
+		owner = &archive.Owner{Uid: int(u.Uid), Gid: int(u.Gid)}
+	}
+
+	layer, diffID, err := b.createLayer(func(w *archive.Writer) error {
+		c := &layerCopier{w: w, root: root, owner: owner, dirs: make(map[string]bool)}
+		for _, source := range sources {
+			if err := c.copy(source, dest, destDir, add); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return b.addLayer(historyEntry{CreatedBy: instruction.text}, layer, diffID)
+}
+
+// copySources returns the files matching source pattern src in srcRoot, or the file ADD downloads from URL src
+func (b *builder) copySources(srcRoot, src string, add bool) ([]copySource, error) {
+	if add && (strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")) {
+		source, err := b.download(src)
+		if err != nil {
+			return nil, err
+		}
+		return []copySource{source}, nil
+	}
+	matches, err := filepath.Glob(filepath.Join(srcRoot, filepath.Clean("/"+src)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid source %s", src)
+	}
+	var sources []copySource
+	for _, match := range matches {
+		rel, err := filepath.Rel(srcRoot, match)
+		if err != nil {
+			return nil, err
+		}
+		// sources never leave the source tree through symlinks
+		p, err := lockerio.ScopedJoin(srcRoot, rel)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read source %s", rel)
+		}
+		sources = append(sources, copySource{path: p, name: filepath.Base(p), info: info})
+	}
+	if len(sources) == 0 {
+		return nil, errors.Errorf("source %s not found", src)
+	}
+	return sources, nil
+}
+
+// download downloads a file ADD copies from rawURL to the build directory
+func (b *builder) download(rawURL string) (copySource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return copySource{}, errors.Wrapf(err, "invalid URL %s", rawURL)
+	}
+	if err := checkOnline(rawURL); err != nil {
+		return copySource{}, err
+	}
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		return copySource{}, errors.Wrapf(err, "couldn't download %s", rawURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return copySource{}, errors.Errorf("couldn't download %s: %s", rawURL, resp.Status)
+	}
+	f, err := ioutil.TempFile(b.tmpDir, "download-")
+	if err != nil {
+		return copySource{}, errors.Wrap(err, "couldn't create download file")
+	}
+	_, err = io.Copy(f, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return copySource{}, errors.Wrapf(err, "couldn't download %s", rawURL)
+	}
+	mtime := time.Now()
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		mtime = modified
+	}
+	if err := os.Chtimes(f.Name(), mtime, mtime); err != nil {
+		return copySource{}, errors.Wrap(err, "couldn't set download time")
+	}
+	info, err := os.Lstat(f.Name())
+	if err != nil {
+		return copySource{}, errors.Wrap(err, "couldn't read download file")
+	}
+	return copySource{path: f.Name(), name: path.Base(u.Path), info: info, url: true}, nil
+}
+
+// layerCopier writes the files of COPY and ADD to a layer, with the directories containing them
+type layerCopier struct {
+	w     *archive.Writer
+	root  string // root file system the files are copied to
+	owner *archive.Owner
+	dirs  map[string]bool // directories written to the layer
+}
+
+// copy writes source to the layer, at dest, or in dest if destDir or dest is a directory
+// the content of a directory, or, for ADD, of a local tar archive, is written in dest
+func (c *layerCopier) copy(source copySource, dest string, destDir, add bool) error {
+	if source.info.IsDir() {
+		dir, err := c.mkdirAll(dest)
+		if err != nil {
+			return err
+		}
+		c.w.Owner = c.owner
+		return c.w.AddTree(source.path, dir)
+	}
+	if add && !source.url {
+		if tr, closer, err := openTarArchive(source.path); err != nil {
+			return err
+		} else if tr != nil {
+			defer closer.Close()
+			dir, err := c.mkdirAll(dest)
+			if err != nil {
+				return err
+			}
+			return c.extract(tr, dir)
+		}
+	}
+
+	if !destDir {
+		if p, err := lockerio.ScopedJoin(c.root, dest); err == nil {
+			if info, err := os.Stat(p); err == nil && info.IsDir() {
+				destDir = true
+			}
+		}
+	}
+	target := dest
+	if destDir {
+		if source.name == "" || source.name == "." || source.name == "/" {
+			return errors.Errorf("can't name %s in %s, use a file destination", source.path, dest)
+		}
+		target = path.Join(dest, source.name)
+	}
+	dir, err := c.mkdirAll(path.Dir(target))
+	if err != nil {
+		return err
+	}
+	name := path.Join(dir, path.Base(target))
+	if source.url {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0600, Size: source.info.Size(), ModTime: source.info.ModTime()}
+		f, err := os.Open(source.path)
+		if err != nil {
+			return errors.Wrap(err, "couldn't read download file")
+		}
+		defer f.Close()
+		c.w.Owner = c.owner
+		return c.w.AddEntry(hdr, f)
+	}
+	c.w.Owner = c.owner
+	return c.w.AddFile(source.path, name, source.info)
+}
+
+// mkdirAll writes directory dir of the root file system, and its parents, to the layer, as they are in the root
+// file system, or as new directories, returns the name of dir in the layer, with symlinks of the root file system resolved
+func (c *layerCopier) mkdirAll(dir string) (string, error) {
+	p, err := lockerio.ScopedJoin(c.root, path.Join(dir, "."+"/x"))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(c.root, filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return "", nil
+	}
+	name := ""
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		name = path.Join(name, part)
+		if c.dirs[name] {
+			continue
+		}
+		c.dirs[name] = true
+		hostPath := filepath.Join(c.root, name)
+		if info, err := os.Lstat(hostPath); err == nil && info.IsDir() {
+			// existing directories keep their ownership, new ones are owned by the owner of the copied files
+			c.w.Owner = nil
+			if err := c.w.AddFile(hostPath, name, info); err != nil {
+				return "", err
+			}
+			continue
+		}
+		// a fixed time keeps the layer, and its cache, the same across builds
+		hdr := &tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755, ModTime: time.Unix(0, 0)}
+		c.w.Owner = c.owner
+		if err := c.w.AddEntry(hdr, nil); err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// extract writes the entries of a tar archive to the layer, in directory dir
+func (c *layerCopier) extract(tr *tar.Reader, dir string) error {
+	c.w.Owner = c.owner
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "couldn't read tar entry")
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name == "" {
+			continue
+		}
+		hdr.Name = path.Join(dir, name)
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = path.Join(dir, strings.TrimPrefix(path.Clean("/"+hdr.Linkname), "/"))
+		}
+		if err := c.w.AddEntry(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// openTarArchive opens the file at p as a tar archive, optionally compressed, returns a nil reader if it isn't one
+func openTarArchive(p string) (*tar.Reader, io.Closer, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "couldn't open %s", p)
+	}
+	br := bufio.NewReader(f)
+	rc, err := decompress(detectCompression(br), br)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil
+	}
+	content := bufio.NewReader(rc)
+	header, _ := content.Peek(512)
+	if _, err := tar.NewReader(strings.NewReader(string(header))).Next(); err != nil {
+		rc.Close()
+		f.Close()
+		return nil, nil, nil
+	}
+	return tar.NewReader(content), multiCloser{rc, f}, nil
+}
+
+// multiCloser closes all of its closers
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var err error
+	for _, c := range m {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// commit stores the image of the last stage by refs, returns its image ID
+func (b *builder) commit(refs []*Reference) (string, error) {
+	s := b.stage
+	s.config.Created = time.Now().UTC()
+	confData, err := json.Marshal(s.config)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't marshal image config")
+	}
+	m := &manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeDockerManifest,
+		Config:        descriptor{MediaType: mediaTypeDockerConfig, Digest: digestBytes(confData), Size: int64(len(confData))},
+		Layers:        s.layers,
+	}
+	if s.oci {
+		m.MediaType, m.Config.MediaType = mediaTypeOCIManifest, mediaTypeOCIConfig
+	}
+	manifestData, err := json.Marshal(m)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't marshal manifest")
+	}
+	manifestDesc := descriptor{Digest: digestBytes(manifestData), Size: int64(len(manifestData))}
+	var created []string
+	if err := createBlob(manifestDesc, manifestData, &created); err != nil {
+		return "", err
+	}
+	if err := createBlob(m.Config, confData, &created); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(b.opts.Output, "Successfully built %s\n", shortDigest(m.Config.Digest))
+	for _, ref := range refs {
+		if err := recordImage(ref, manifestDesc.Digest, manifestDesc.Digest, m, s.config, s.layerDirs, true); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(b.opts.Output, "Successfully tagged %s\n", ref)
+	}
+	return m.Config.Digest, nil
+}
@@ -0,0 +1,145 @@
+package image
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// applyChange applies a Dockerfile instruction to c, ENV, CMD, ENTRYPOINT, WORKDIR, USER and LABEL are supported
+// CMD and ENTRYPOINT take a JSON array, or a command run by /bin/sh -c
+func (c *ContainerConfig) applyChange(change string) error {
+	change = strings.TrimSpace(change)
+	instruction, args := splitFirstWord(change)
+	if args == "" {
+		return errors.Errorf("invalid change %q, %s needs arguments", change, instruction)
+	}
+	switch strings.ToUpper(instruction) {
+	case "ENV":
+		pairs, err := parseEnv(args)
+		if err != nil {
+			return errors.Wrapf(err, "invalid change %q", change)
+		}
+		for _, pair := range pairs {
+			c.setEnv(pair)
+		}
+	case "LABEL":
+		pairs, err := parseEnv(args)
+		if err != nil {
+			return errors.Wrapf(err, "invalid change %q", change)
+		}
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		for _, pair := range pairs {
+			kv := strings.SplitN(pair, "=", 2)
+			c.Labels[kv[0]] = kv[1]
+		}
+	case "USER":
+		c.User = args
+	case "CMD":
+		c.Cmd = parseCommand(args)
+	case "ENTRYPOINT":
+		c.Entrypoint = parseCommand(args)
+	case "WORKDIR":
+		// relative directories are relative to the previous working directory
+		if !path.IsAbs(args) {
+			args = path.Join("/", c.WorkingDir, args)
+		}
+		c.WorkingDir = path.Clean(args)
+	default:
+		return errors.Errorf("invalid change %q, only ENV, CMD, ENTRYPOINT, WORKDIR, USER and LABEL are supported", change)
+	}
+	return nil
+}
+
+// setEnv sets environment variable pair (KEY=VALUE), replacing its previous value
+func (c *ContainerConfig) setEnv(pair string) {
+	key := strings.SplitN(pair, "=", 2)[0]
+	for i, env := range c.Env {
+		if strings.SplitN(env, "=", 2)[0] == key {
+			c.Env[i] = pair
+			return
+		}
+	}
+	c.Env = append(c.Env, pair)
+}
+
+// parseEnv parses the arguments of ENV or LABEL, KEY=VALUE pairs with optional quoting, or a single KEY VALUE
+func parseEnv(args string) ([]string, error) {
+	words, err := splitWords(args)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(words[0], "=") {
+		// the value is the rest of the line, as is
+		key := words[0]
+		value := strings.TrimSpace(strings.TrimPrefix(args, key))
+		if value == "" {
+			return nil, errors.Errorf("%s has no value", key)
+		}
+		return []string{key + "=" + value}, nil
+	}
+	for _, word := range words {
+		if strings.HasPrefix(word, "=") || !strings.Contains(word, "=") {
+			return nil, errors.Errorf("%q is not KEY=VALUE", word)
+		}
+	}
+	return words, nil
+}
+
+// parseCommand parses the arguments of CMD or ENTRYPOINT
+func parseCommand(args string) []string {
+	if strings.HasPrefix(args, "[") {
+		var cmd []string
+		if err := json.Unmarshal([]byte(args), &cmd); err == nil {
+			return cmd
+		}
+	}
+	return []string{"/bin/sh", "-c", args}
+}
+
+// splitWords splits s to words on whitespace, quotes and backslash escapes are removed
+func splitWords(s string) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
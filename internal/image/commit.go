@@ -0,0 +1,125 @@
+package image
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"gitlab.com/amit-yuval/locker/internal/archive"
+
+	"github.com/pkg/errors"
+)
+
+// CommitContainer creates image imageName from the image of a container and its changes, returns its image ID
+// container is the ID of a running container, or of a stopped one kept by locker run --rm=false, or its --name
+// changes are Dockerfile instructions setting the Env, Cmd, Entrypoint, WorkingDir, User and Labels of the image
+func CommitContainer(container, imageName string, changes []string) (string, error) {
+	dir, err := findContainer(container)
+	if err != nil {
+		return "", err
+	}
+	return commitContainer(dir, imageName, changes)
+}
+
+// Commit creates image imageName from the image of the container and its changes, returns its image ID
+func (c *ImageConfig) Commit(imageName string, changes []string) (string, error) {
+	return commitContainer(c.Dir, imageName, changes)
+}
+
+// findContainer returns the directory of a container by ID or name
+func findContainer(container string) (string, error) {
+	entries, err := ioutil.ReadDir(containersDir)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't read containers directory")
+	}
+	var found []string
+	for _, entry := range entries {
+		dir := filepath.Join(containersDir, entry.Name())
+		if entry.Name() == container {
+			return dir, nil
+		}
+		if r := readContainerRecord(dir); r != nil && r.Name == container {
+			found = append(found, dir)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", errors.Errorf("container %s not found", container)
+	case 1:
+		return found[0], nil
+	}
+	return "", errors.Errorf("%d containers are named %s, commit one by its ID", len(found), container)
+}
+
+// commitContainer creates image imageName from the container in dir, its upper directory becomes a layer
+// above the layers of its image, returns the image ID
+func commitContainer(dir, imageName string, changes []string) (string, error) {
+	ref, err := ParseReference(imageName)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return "", errors.Errorf("can't commit image %s by digest", ref)
+	}
+	r := readContainerRecord(dir)
+	switch {
+	case r == nil:
+		return "", errors.Errorf("container %s has no record", filepath.Base(dir))
+	case r.Rootfs != "":
+		return "", errors.Errorf("container %s runs host directory %s, not an image", filepath.Base(dir), r.Rootfs)
+	case len(r.Layers) > 0:
+		return "", errors.Errorf("container %s has host layers, which can't be part of an image", filepath.Base(dir))
+	case r.ImageDigest == "":
+		return "", errors.Errorf("image of container %s is unknown", filepath.Base(dir))
+	}
+
+	// pulls and commits create layers and blobs before they are recorded in the store
+	unlockPulls, err := lockPulls(false)
+	if err != nil {
+		return "", err
+	}
+	defer unlockPulls()
+	store, err := readStore()
+	if err != nil {
+		return "", err
+	}
+	imageRef, err := ParseReference(r.Image)
+	if err != nil {
+		return "", err
+	}
+	// the tag of the image may have moved since the container started, any reference of the image will do
+	base, ok := store.get(imageRef)
+	if ok && base.ManifestDigest != r.ImageDigest {
+		base = nil
+	}
+	for _, name := range store.names() {
+		if record := store.Images[name]; base == nil && record.ManifestDigest == r.ImageDigest {
+			base = record
+		}
+	}
+	if base == nil {
+		return "", errors.Errorf("image %s of container %s was removed", imageRef, filepath.Base(dir))
+	}
+	stage, err := imageStage(imageRef, base)
+	if err != nil {
+		return "", err
+	}
+	for _, change := range changes {
+		if err := stage.config.Config.applyChange(change); err != nil {
+			return "", err
+		}
+	}
+
+	b := &builder{opts: BuildOptions{Output: ioutil.Discard}, stage: stage}
+	layer, diffID, err := b.createLayer(func(w *archive.Writer) error {
+		w.Overlay, w.Exclude = true, runtimeFiles
+		return w.AddTree(filepath.Join(dir, upper), "")
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't commit container %s", filepath.Base(dir))
+	}
+	history := historyEntry{Comment: "Committed from container " + filepath.Base(dir)}
+	if err := b.addLayer(history, layer, diffID); err != nil {
+		return "", err
+	}
+	return b.commit([]*Reference{ref})
+}
@@ -0,0 +1,163 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaTypeDockerLayer         = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeDockerLayerGzip     = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerForeignLayer  = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+	mediaTypeOCILayer            = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGzip        = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeOCILayerZstd        = "application/vnd.oci.image.layer.v1.tar+zstd"
+	mediaTypeOCINonDistributable = "application/vnd.oci.image.layer.nondistributable.v1.tar"
+)
+
+// compression is the compression algorithm of a layer blob
+type compression int
+
+const (
+	uncompressed compression = iota
+	gzipCompressed
+	zstdCompressed
+)
+
+// layerCompression returns the compression of a layer by its media type,
+// fails for layers locker can't unpack (foreign, encrypted or unknown)
+func layerCompression(mediaType string) (compression, error) {
+	switch {
+	case strings.HasSuffix(mediaType, "+encrypted"):
+		return 0, errors.Errorf("encrypted layers (%s) are not supported", mediaType)
+	case mediaType == mediaTypeDockerForeignLayer || strings.HasPrefix(mediaType, mediaTypeOCINonDistributable):
+		return 0, errors.Errorf("foreign layers (%s) are not supported", mediaType)
+	}
+	switch mediaType {
+	case mediaTypeDockerLayer, mediaTypeOCILayer:
+		return uncompressed, nil
+	case mediaTypeDockerLayerGzip, mediaTypeOCILayerGzip, "":
+		return gzipCompressed, nil
+	case mediaTypeOCILayerZstd:
+		return zstdCompressed, nil
+	default:
+		return 0, errors.Errorf("unsupported layer media type %s", mediaType)
+	}
+}
+
+// layerMediaType returns the media type of layers compressed with c, in OCI or docker manifests
+func layerMediaType(c compression, oci bool) string {
+	switch {
+	case c == zstdCompressed:
+		return mediaTypeOCILayerZstd
+	case c == gzipCompressed && oci:
+		return mediaTypeOCILayerGzip
+	case c == gzipCompressed:
+		return mediaTypeDockerLayerGzip
+	case oci:
+		return mediaTypeOCILayer
+	default:
+		return mediaTypeDockerLayer
+	}
+}
+
+// detectCompression returns the compression of the content read by r, by its magic bytes
+func detectCompression(r *bufio.Reader) compression {
+	magic, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzipCompressed
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return zstdCompressed
+	default:
+		return uncompressed
+	}
+}
+
+// decompress returns a reader of the uncompressed content of r
+func decompress(c compression, r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case gzipCompressed:
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't decompress gzip layer")
+		}
+		return gzipReader, nil
+	case zstdCompressed:
+		return newZstdReader(r)
+	default:
+		return ioutil.NopCloser(r), nil
+	}
+}
+
+// checkZstd fails with a clear error if the zstd binary, which decompresses zstd layers, isn't installed
+func checkZstd() error {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		return errors.New("zstd compressed layers require the zstd binary, install zstd (e.g. apt install zstd)")
+	}
+	return nil
+}
+
+// checkLayers fails if layers can't be unpacked, so an image isn't downloaded or stored before it fails
+func checkLayers(layers []descriptor) error {
+	zstd := false
+	for _, layer := range layers {
+		c, err := layerCompression(layer.MediaType)
+		if err != nil {
+			return errors.Wrapf(err, "layer %s", layer.Digest)
+		}
+		zstd = zstd || c == zstdCompressed
+	}
+	if zstd {
+		return checkZstd()
+	}
+	return nil
+}
+
+// zstdReader decompresses zstd content with the zstd binary
+type zstdReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	closed bool
+}
+
+// newZstdReader starts "zstd -dc" on r, returns a reader of its output
+func newZstdReader(r io.Reader) (*zstdReader, error) {
+	if err := checkZstd(); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("zstd", "-dc")
+	cmd.Stdin = r
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create zstd pipe")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "couldn't start zstd")
+	}
+	return &zstdReader{ReadCloser: stdout, cmd: cmd, stderr: stderr}, nil
+}
+
+// Close waits for zstd to exit, fails if the content couldn't be decompressed
+func (z *zstdReader) Close() error {
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+	// drain output, so zstd doesn't block on a full pipe
+	io.Copy(ioutil.Discard, z.ReadCloser)
+	if err := z.cmd.Wait(); err != nil {
+		return errors.Wrapf(err, "couldn't decompress zstd layer: %s", strings.TrimSpace(z.stderr.String()))
+	}
+	return nil
+}
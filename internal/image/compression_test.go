@@ -0,0 +1,35 @@
+package image
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckLayers(t *testing.T) {
+	layer := func(mediaType string) descriptor {
+		return descriptor{MediaType: mediaType, Digest: digestBytes([]byte(mediaType))}
+	}
+	tests := []struct {
+		name   string
+		layers []descriptor
+		err    string
+	}{
+		{"supported", []descriptor{layer(mediaTypeDockerLayerGzip), layer(mediaTypeOCILayer), layer("")}, ""},
+		{"encrypted after zstd", []descriptor{layer(mediaTypeOCILayerZstd), layer(mediaTypeOCILayerGzip + "+encrypted")}, "encrypted"},
+		{"foreign after zstd", []descriptor{layer(mediaTypeOCILayerZstd), layer(mediaTypeDockerForeignLayer)}, "foreign"},
+		{"unknown after zstd", []descriptor{layer(mediaTypeOCILayerZstd), layer("application/x-unknown")}, "unsupported"},
+		{"zstd without binary", []descriptor{layer(mediaTypeOCILayerGzip), layer(mediaTypeOCILayerZstd)}, "zstd binary"},
+	}
+	// no zstd binary is found
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", "")
+	for _, test := range tests {
+		err := checkLayers(test.layers)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.err)
+		}
+	}
+}
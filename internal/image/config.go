@@ -0,0 +1,126 @@
+package image
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultPath is the PATH of containers whose image doesn't set one
+const defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// ContainerConfig is the configuration an image sets for containers running it
+type ContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+}
+
+// imageConfigFile is the image config blob (OCI image config and docker image JSON)
+type imageConfigFile struct {
+	platform
+	Created time.Time       `json:"created"`
+	Author  string          `json:"author,omitempty"`
+	Config  ContainerConfig `json:"config"`
+	RootFS  struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []historyEntry `json:"history,omitempty"`
+}
+
+// historyEntry describes the step that created a layer of an image, or a step that changed its config only
+type historyEntry struct {
+	Created    time.Time `json:"created,omitempty"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+// ReadImageConfig returns the container configuration of a local image
+func ReadImageConfig(imageName string) (*ContainerConfig, error) {
+	_, record, err := lookupImage(imageName)
+	if err != nil {
+		return nil, err
+	}
+	imageConfig, err := record.config()
+	if err != nil {
+		return nil, err
+	}
+	c := imageConfig.Config
+	c.setDefaults()
+	return &c, nil
+}
+
+// DefaultContainerConfig returns the configuration of containers running a root file system that has no image config
+func DefaultContainerConfig() *ContainerConfig {
+	c := &ContainerConfig{}
+	c.setDefaults()
+	return c
+}
+
+// setDefaults sets the PATH and working directory of c, if unset
+func (c *ContainerConfig) setDefaults() {
+	if !c.hasEnv("PATH") {
+		c.Env = append(c.Env, defaultPath)
+	}
+	if c.WorkingDir == "" {
+		c.WorkingDir = "/"
+	}
+}
+
+// config returns the image config of the record
+func (r *imageRecord) config() (*imageConfigFile, error) {
+	data, err := readConfigBlob(r.ConfigDigest)
+	if err != nil {
+		return nil, err
+	}
+	var imageConfig imageConfigFile
+	if err := json.Unmarshal(data, &imageConfig); err != nil {
+		return nil, errors.Wrap(err, "couldn't load config from json file")
+	}
+	return &imageConfig, nil
+}
+
+// hasEnv returns true if the config sets environment variable key
+func (c *ContainerConfig) hasEnv(key string) bool {
+	for _, env := range c.Env {
+		if strings.SplitN(env, "=", 2)[0] == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Command returns the command of a container, the entrypoint of the image followed by args,
+// or by the cmd of the image if no args are given
+func (c *ContainerConfig) Command(args []string) ([]string, error) {
+	if len(args) == 0 {
+		args = c.Cmd
+	}
+	cmd := append(append([]string{}, c.Entrypoint...), args...)
+	if len(cmd) == 0 {
+		return nil, errors.New("no command specified, and the image has no entrypoint or cmd")
+	}
+	return cmd, nil
+}
+
+// VolumePaths returns the sorted paths of the anonymous volumes of the image
+func (c *ContainerConfig) VolumePaths() []string {
+	paths := make([]string, 0, len(c.Volumes))
+	for path := range c.Volumes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
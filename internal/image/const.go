@@ -1,16 +1,34 @@
 package image
 
+// paths of the image store, variables so tests can use a temporary store
+var (
+	imagesDir      = "/var/lib/locker/"
+	imagesJsonFile = imagesDir + "images.json"
+	storeFile      = imagesDir + "imagedb.json"
+	storeLockFile  = imagesDir + "imagedb.lock"
+	pullLockFile   = imagesDir + "pull.lock"
+	containersDir  = imagesDir + "containers/"
+	blobsDir       = imagesDir + "blobs/sha256/"
+	layersDir      = imagesDir + "layers/sha256/"
+)
+
 const (
-	imagesDir       = "/var/lib/locker/"
-	imagesJsonFile  = imagesDir + "images.json"
-	configFile      = "config.json"
-	work            = "work"
-	upper           = "upper"
-	registry        = "https://registry-1.docker.io/v2/"
-	authUrlIndex    = 1
-	authHeaderIndex = 3
-	idPrintLen      = 10
-	lsPrintPad      = 23
+	containerFile       = "container.json"
+	configFile          = "config.json"
+	manifestFile        = "manifest.json"
+	platformFile        = "platform"
+	volumesDir          = "volumes"
+	work                = "work"
+	upper               = "upper"
+	defaultRegistry     = "docker.io"
+	defaultRegistryHost = "registry-1.docker.io"
+	officialNamespace   = "library/"
+	defaultTag          = "latest"
+	idPrintLen          = 10
+	lsPrintPad          = 18
+	historyCreatedByPad = 48
+	historyTimeFormat   = "2006-01-02 15:04"
+	containerDirPrefix  = "cntr-"
 	// Merged directory, mountpoint for container
 	Merged = "merged"
 )
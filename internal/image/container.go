@@ -0,0 +1,136 @@
+package image
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// containerCreateGrace is the time a new container directory may have no record
+const containerCreateGrace = time.Minute
+
+// containerRecord is the metadata of a container, stored in its directory
+type containerRecord struct {
+	Name        string    `json:"name,omitempty"`
+	Image       string    `json:"image,omitempty"`       // reference of the image the container runs
+	ImageDigest string    `json:"imageDigest,omitempty"` // digest of the manifest of the image
+	Rootfs      string    `json:"rootfs,omitempty"`      // host directory the container runs, instead of an image
+	Layers      []string  `json:"layers,omitempty"`      // host directories mounted above the image
+	Pid         int       `json:"pid"`                   // pid of the locker process running the container
+	Created     time.Time `json:"created"`
+}
+
+// writeContainerRecord stores record r of a container run by the current process in dir
+func writeContainerRecord(dir string, r containerRecord) error {
+	r.Pid, r.Created = os.Getpid(), time.Now().UTC()
+	data, err := json.Marshal(&r)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal container record")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, containerFile), data, 0644); err != nil {
+		return errors.Wrap(err, "couldn't write container record")
+	}
+	return nil
+}
+
+// readContainerRecord reads the record of the container in dir, returns nil if it has none
+// containers created by older versions of locker have no record
+func readContainerRecord(dir string) *containerRecord {
+	data, err := ioutil.ReadFile(filepath.Join(dir, containerFile))
+	if err != nil {
+		return nil
+	}
+	var r containerRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil
+	}
+	return &r
+}
+
+// containerImages returns the manifest digests of the images of all containers, running or kept stopped
+func containerImages() (map[string]bool, error) {
+	dirs, err := containerDirs()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, dir := range dirs {
+		if r := readContainerRecord(dir); r != nil && r.ImageDigest != "" {
+			used[r.ImageDigest] = true
+		}
+	}
+	return used, nil
+}
+
+// runningImages returns the references and manifest digests of the images of running containers
+func runningImages() (map[string]bool, error) {
+	dirs, err := containerDirs()
+	if err != nil {
+		return nil, err
+	}
+	roots := processRoots()
+	running := make(map[string]bool)
+	for _, dir := range dirs {
+		if !containerRunning(dir, roots) {
+			continue
+		}
+		if r := readContainerRecord(dir); r != nil {
+			running[r.Image] = true
+			if r.ImageDigest != "" {
+				running[r.ImageDigest] = true
+			}
+		}
+	}
+	return running, nil
+}
+
+// processAlive returns true if a process with pid exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
+
+// processRoots returns the root directories of all processes, processes of containers are chrooted into them
+func processRoots() []string {
+	var roots []string
+	procs, _ := filepath.Glob("/proc/[0-9]*/root")
+	for _, proc := range procs {
+		if root, err := os.Readlink(proc); err == nil && root != "/" {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// isSubpath returns true if path is dir or inside it
+func isSubpath(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// containerRunning returns true if the container in dir is in use: the locker process running it is alive,
+// or a process is chrooted into it, which covers containers of older versions of locker and of a killed locker
+// a container directory without a record is in use while it is new, its record is being written
+func containerRunning(dir string, roots []string) bool {
+	if r := readContainerRecord(dir); r != nil && processAlive(r.Pid) {
+		return true
+	} else if r == nil && filepath.Dir(dir) == filepath.Clean(containersDir) {
+		if info, err := os.Stat(dir); err == nil && time.Since(info.ModTime()) < containerCreateGrace {
+			return true
+		}
+	}
+	for _, root := range roots {
+		if isSubpath(root, dir) {
+			return true
+		}
+	}
+	return false
+}
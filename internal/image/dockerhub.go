@@ -2,20 +2,33 @@ package image
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
 	"strings"
+	"sync"
 
-	"github.com/codeclysm/extract"
 	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 )
 
+// registryClient talks to the registry HTTP API V2 on behalf of a single repository
+type registryClient struct {
+	client     *http.Client
+	endpoint   string // base url of the registry API, e.g. https://registry-1.docker.io/v2/
+	repository string
+	username   string // registry credentials, empty for anonymous access
+	password   string
+	authHeader string          // value of the Authorization header, empty for anonymous access
+	mountFrom  string          // repository of the registry blobs are mounted from, pull access to it is requested as well
+	fallback   *mirrorFallback // set if the registry is a mirror, retries its failed requests
+}
+
 // toJson convert http response to json
 func toJson(resp *http.Response) map[string]interface{} {
 	ret := make(map[string]interface{})
@@ -30,121 +43,363 @@ func setHeaders(req *http.Request, headers map[string]string) {
 	}
 }
 
-// PullImage pulls latest version of requested image from dockerhub
-func PullImage(imageName string) error {
-	imageDir := filepath.Join(imagesDir, imageName)
-	if _, err := os.Stat(imageDir); !os.IsNotExist(err) {
-		return fmt.Errorf("Image %s exists", imageName)
+// registryHost returns the host serving the registry API of given registry
+func registryHost(registry string) string {
+	if registry == defaultRegistry {
+		return defaultRegistryHost
 	}
+	return registry
+}
 
-	repository := "library/" + imageName
-	client := &http.Client{}
-	authUrl := "https://auth.docker.io/token"
-	regService := "registry.docker.io"
-	regResp, err := http.Get(registry)
-	if err != nil {
-		return errors.Wrap(err, "error getting registry")
+// isInsecureRegistry returns true if registry may be accessed over plain HTTP or without TLS verification
+func isInsecureRegistry(registry string) bool {
+	host := strings.Split(registry, ":")[0]
+	if host == "localhost" || host == "127.0.0.1" {
+		return true
+	}
+	for _, insecure := range viper.GetStringSlice("insecure-registry") {
+		if insecure == registry {
+			return true
+		}
 	}
+	return false
+}
 
-	if regResp.StatusCode == 401 {
-		authHeader := strings.Split(regResp.Header["Www-Authenticate"][0], `"`)
-		authUrl = authHeader[authUrlIndex]
-		if len(authHeader) > authHeaderIndex {
-			regService = authHeader[authHeaderIndex]
-		} else {
-			regService = ""
+// checkOnline returns an error if locker is offline, what is the network resource locker was about to access
+func checkOnline(what string) error {
+	if viper.GetBool("offline") {
+		return errors.Errorf("locker is offline, can't access %s", what)
+	}
+	return nil
+}
+
+// newRegistryClient connects to the registry of ref, and authenticates for requested actions (e.g. "pull")
+// with the credentials stored for the registry, if any
+func newRegistryClient(ref *Reference, actions string) (*registryClient, error) {
+	return newMountingClient(ref, actions, "")
+}
+
+// registryMirrors returns the mirrors configured for registry, host[:port] of each, in the order they are tried
+func registryMirrors(registry string) ([]string, error) {
+	var mirrors []string
+	for _, entry := range viper.GetStringSlice("registry-mirror") {
+		split := strings.SplitN(entry, "=", 2)
+		if len(split) != 2 {
+			return nil, errors.Errorf("invalid registry mirror %q, expected REGISTRY=MIRROR", entry)
+		}
+		mirror := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(split[1], "https://"), "http://"), "/")
+		if !hostRegexp.MatchString(mirror) {
+			return nil, errors.Errorf("invalid registry mirror %q, expected REGISTRY=HOST[:PORT]", entry)
+		}
+		if normalizeAuthKey(split[0]) == registry {
+			mirrors = append(mirrors, mirror)
 		}
 	}
+	return mirrors, nil
+}
 
-	authResp, err := http.Get(fmt.Sprintf("%s?service=%s&scope=repository:%s:pull", authUrl, regService, repository))
+// mirrorFallback connects, once, to the endpoint requests a mirror fails are retried on
+type mirrorFallback struct {
+	mirror  string           // host of the mirror that falls back
+	warn    func(msg string) // reports failures of the mirror
+	connect func() (*registryClient, error)
+	once    sync.Once
+	client  *registryClient
+	err     error
+}
+
+// next returns the client of the endpoint after the mirror
+func (f *mirrorFallback) next() (*registryClient, error) {
+	f.once.Do(func() { f.client, f.err = f.connect() })
+	return f.client, f.err
+}
+
+// newPullClient connects to the first mirror of the registry of ref that responds, and authenticates for pulls
+// requests a mirror fails are retried on the next mirror, and finally on the registry itself, warn reports each failure
+// mirrors serve the repository of ref under the same name, with the credentials stored for them,
+// and over plain HTTP if they are insecure registries
+func newPullClient(ref *Reference, warn func(msg string)) (*registryClient, error) {
+	mirrors, err := registryMirrors(ref.Registry)
 	if err != nil {
-		errors.Wrapf(err, "error getting repository %s", repository)
+		return nil, err
 	}
+	return connectMirrors(ref, mirrors, warn)
+}
 
-	accessToken := toJson(authResp)["token"].(string)
-	authHead := map[string]string{
-		"Authorization": "Bearer " + accessToken,
-		"Accept":        "application/vnd.docker.distribution.manifest.v2+json",
+// connectMirrors connects to the first of mirrors that responds, or to the registry of ref if none does
+func connectMirrors(ref *Reference, mirrors []string, warn func(msg string)) (*registryClient, error) {
+	if len(mirrors) == 0 {
+		return newRegistryClient(ref, "pull")
 	}
-
-	manifestReq, err := http.NewRequest("GET", fmt.Sprintf("%s/%s/manifests/%s", registry, repository, "latest"), nil)
+	c, err := newRegistryClient(&Reference{Registry: mirrors[0], Repository: ref.Repository}, "pull")
 	if err != nil {
-		return errors.Wrap(err, "error creating manifest request")
+		warn(fmt.Sprintf("Mirror %s failed: %v", mirrors[0], err))
+		return connectMirrors(ref, mirrors[1:], warn)
+	}
+	c.fallback = &mirrorFallback{
+		mirror:  mirrors[0],
+		warn:    warn,
+		connect: func() (*registryClient, error) { return connectMirrors(ref, mirrors[1:], warn) },
 	}
-	setHeaders(manifestReq, authHead)
-	manifestResp, err := client.Do(manifestReq)
+	return c, nil
+}
+
+// newMountingClient connects to the registry of ref like newRegistryClient, and requests pull access to repository
+// mountFrom of the registry as well, so its blobs can be mounted to the repository of ref
+func newMountingClient(ref *Reference, actions, mountFrom string) (*registryClient, error) {
+	username, password, err := getCredentials(ref.Registry)
 	if err != nil {
-		return errors.Wrap(err, "error sending manifest request")
+		return nil, err
 	}
+	return newAuthenticatedClient(ref, actions, mountFrom, username, password)
+}
 
-	manifestBody := toJson(manifestResp)
-	layers, ok := manifestBody["layers"]
-	if !ok {
-		return fmt.Errorf("Repository %s request invalid", repository)
+// newAuthenticatedClient connects to the registry of ref, and authenticates for requested actions with given credentials
+func newAuthenticatedClient(ref *Reference, actions, mountFrom, username, password string) (*registryClient, error) {
+	if err := checkOnline("registry " + ref.Registry); err != nil {
+		return nil, err
 	}
-	config := manifestBody["config"].(map[string]interface{})["digest"].(string)
-	confReq, err := http.NewRequest("GET", fmt.Sprintf("%s%s/blobs/%s", registry, repository, config), nil)
-	if err != nil {
-		return errors.Wrap(err, "error creating config request")
+	host := registryHost(ref.Registry)
+	c := &registryClient{
+		client:     &http.Client{},
+		repository: ref.Repository,
+		username:   username,
+		password:   password,
+		mountFrom:  mountFrom,
+	}
+	schemes := []string{"https"}
+	if isInsecureRegistry(ref.Registry) {
+		c.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		schemes = append(schemes, "http")
+	}
+
+	var (
+		regResp *http.Response
+		err     error
+	)
+	for _, scheme := range schemes {
+		c.endpoint = fmt.Sprintf("%s://%s/v2/", scheme, host)
+		if regResp, err = c.client.Get(c.endpoint); err == nil {
+			break
+		}
 	}
-	setHeaders(confReq, authHead)
-	confResp, err := client.Do(confReq)
 	if err != nil {
-		return errors.Wrap(err, "error receiving config request")
+		return nil, errors.Wrapf(err, "error getting registry %s", ref.Registry)
 	}
+	regResp.Body.Close()
 
-	if err := os.Mkdir(imageDir, 0744); err != nil {
-		return err
+	switch regResp.StatusCode {
+	case http.StatusOK:
+		return c, nil
+	case http.StatusUnauthorized:
+		if err := c.authenticate(regResp.Header.Get("Www-Authenticate"), actions); err != nil {
+			return nil, err
+		}
+		return c, nil
+	default:
+		return nil, errors.Errorf("registry %s responded with %s", ref.Registry, regResp.Status)
 	}
+}
 
-	confFile, err := os.Create(filepath.Join(imageDir, configFile))
-	if err != nil {
-		return errors.Wrap(err, "error creating config file")
-	}
-	defer confFile.Close()
-	if _, err := io.Copy(confFile, confResp.Body); err != nil {
-		return errors.Wrap(err, "couldn't write to config file")
-	}
-
-	var layerList []string
-	parentId := ""
-	for _, layer := range layers.([]interface{}) {
-		layer := layer.(map[string]interface{})
-		ublob := layer["digest"].(string)
-		hash := sha256.New()
-		hash.Write([]byte(parentId + ublob))
-		fakeLayerId := hex.EncodeToString(hash.Sum(nil))
-		layerDir := filepath.Join(imageDir, fakeLayerId)
-		err := os.Mkdir(layerDir, 0744)
-		if err != nil {
-			return errors.Wrapf(err, "error creating layer %s directory", fakeLayerId)
+// parseChallenge parses a Www-Authenticate header, returns auth scheme and its parameters
+func parseChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+	split := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	scheme := strings.ToLower(split[0])
+	if len(split) == 1 {
+		return scheme, params
+	}
+	rest := split[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq == -1 {
+			break
 		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma != -1 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+	return scheme, params
+}
 
-		fmt.Println("Pulling fs layer", fakeLayerId[:idPrintLen])
-		req, err := http.NewRequest("GET", fmt.Sprintf("%s%s/blobs/%s", registry, repository, ublob), nil)
+// authenticate answers given registry challenge, sets the authorization header of the client
+func (c *registryClient) authenticate(challenge, actions string) error {
+	scheme, params := parseChallenge(challenge)
+	switch scheme {
+	case "bearer":
+		token, err := c.fetchToken(params, actions)
 		if err != nil {
-			return errors.Wrap(err, "error creating blob request")
+			return err
 		}
-		setHeaders(req, authHead)
-		blobResp, err := client.Do(req)
-		if err != nil {
-			return errors.Wrap(err, "error sending blob request")
+		c.authHeader = "Bearer " + token
+	case "basic":
+		if c.username == "" {
+			return errors.Errorf("registry requires authentication for repository %s, use locker login", c.repository)
 		}
+		c.authHeader = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+		return c.verifyBasicAuth()
+	default:
+		return errors.Errorf("unsupported registry authentication scheme %q", scheme)
+	}
+	return nil
+}
 
-		if err := extract.Gz(context.Background(), blobResp.Body, layerDir, nil); err != nil {
-			return errors.Wrapf(err, "error extracting layer %s", fakeLayerId)
-		}
+// fetchToken requests a bearer token for the repository from the realm of the challenge
+func (c *registryClient) fetchToken(params map[string]string, actions string) (string, error) {
+	realm, ok := params["realm"]
+	if !ok {
+		return "", errors.New("registry authentication challenge is missing a realm")
+	}
+	authUrl, err := url.Parse(realm)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid authentication realm %q", realm)
+	}
+	query := authUrl.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	if actions != "" {
+		query.Set("scope", fmt.Sprintf("repository:%s:%s", c.repository, actions))
+	}
+	if c.mountFrom != "" {
+		query.Add("scope", fmt.Sprintf("repository:%s:pull", c.mountFrom))
+	}
+	if c.username != "" {
+		query.Set("account", c.username)
+	}
+	authUrl.RawQuery = query.Encode()
 
-		layerList = append(layerList, layerDir)
+	authReq, err := http.NewRequest("GET", authUrl.String(), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "error creating token request")
 	}
-	imagesMap, err := getImagesMap()
+	if c.username != "" {
+		authReq.SetBasicAuth(c.username, c.password)
+	}
+	authResp, err := c.client.Do(authReq)
 	if err != nil {
-		return err
+		return "", errors.Wrapf(err, "error getting token for repository %s", c.repository)
+	}
+	defer authResp.Body.Close()
+	switch {
+	case authResp.StatusCode == http.StatusUnauthorized && c.username != "":
+		return "", errors.New("invalid registry credentials")
+	case authResp.StatusCode == http.StatusUnauthorized || authResp.StatusCode == http.StatusForbidden:
+		return "", errors.Errorf("access to repository %s denied: %s, if the repository is private use locker login", c.repository, authResp.Status)
+	case authResp.StatusCode != http.StatusOK:
+		return "", errors.Errorf("error getting token for repository %s: %s", c.repository, authResp.Status)
 	}
-	imagesMap[imageName] = layerList
-	if err := updateImagesJson(imagesMap); err != nil {
-		return err
+
+	body := toJson(authResp)
+	for _, key := range []string{"token", "access_token"} {
+		if token, ok := body[key].(string); ok && token != "" {
+			return token, nil
+		}
 	}
+	return "", errors.Errorf("no token received for repository %s", c.repository)
+}
 
+// verifyBasicAuth checks that the registry accepts the basic credentials of the client
+func (c *registryClient) verifyBasicAuth() error {
+	req, err := http.NewRequest("GET", c.endpoint, nil)
+	if err != nil {
+		return errors.Wrap(err, "error creating registry request")
+	}
+	req.Header.Set("Authorization", c.authHeader)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error getting registry")
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errors.New("invalid registry credentials")
+	}
 	return nil
 }
+
+// statusError is returned for unexpected status codes of registry responses
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+// repositoryURL returns the url of path, relative to the repository, in the registry API
+func (c *registryClient) repositoryURL(path string) string {
+	return fmt.Sprintf("%s%s/%s", c.endpoint, c.repository, path)
+}
+
+// send sends a request to url of the registry, with the authorization of the client, and size bytes of body if it isn't nil
+// the response is returned whatever its status code
+func (c *registryClient) send(ctx context.Context, method, url string, body io.Reader, size int64, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating registry request")
+	}
+	if body != nil {
+		req.Body, req.ContentLength = ioutil.NopCloser(body), size
+	}
+	req = req.WithContext(ctx)
+	setHeaders(req, headers)
+	if c.authHeader != "" {
+		req.Header.Set("Authorization", c.authHeader)
+	}
+	return c.client.Do(req)
+}
+
+// get sends a GET request for path (relative to the repository) to the registry
+// if the registry is a mirror, a failed request is retried on the endpoint it falls back to
+func (c *registryClient) get(ctx context.Context, path string, headers map[string]string) (*http.Response, error) {
+	resp, err := c.request(ctx, path, headers)
+	if err == nil || c.fallback == nil || ctx.Err() != nil {
+		return resp, err
+	}
+	c.fallback.warn(fmt.Sprintf("Mirror %s failed: %v", c.fallback.mirror, err))
+	next, err := c.fallback.next()
+	if err != nil {
+		return nil, err
+	}
+	return next.get(ctx, path, headers)
+}
+
+// request sends a GET request for path (relative to the repository) to the registry, fails on unexpected status codes
+func (c *registryClient) request(ctx context.Context, path string, headers map[string]string) (*http.Response, error) {
+	resp, err := c.send(ctx, "GET", c.repositoryURL(path), nil, 0, headers)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error sending request for %s", path)
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent:
+	case (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusNotFound) && c.username == "":
+		resp.Body.Close()
+		return nil, &statusError{
+			code: resp.StatusCode,
+			msg:  fmt.Sprintf("request for %s of repository %s failed: %s, if the repository is private use locker login", path, c.repository, resp.Status),
+		}
+	default:
+		resp.Body.Close()
+		return nil, &statusError{
+			code: resp.StatusCode,
+			msg:  fmt.Sprintf("request for %s of repository %s failed: %s", path, c.repository, resp.Status),
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,138 @@
+package image
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{`Basic`, "basic", map[string]string{}},
+		{`Basic realm="registry"`, "basic", map[string]string{"realm": "registry"}},
+		{
+			`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`,
+			"bearer",
+			map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/alpine:pull"},
+		},
+		{`bearer Realm=https://auth/token, Service=reg`, "bearer", map[string]string{"realm": "https://auth/token", "service": "reg"}},
+		{`Bearer realm="a,b", service="c"`, "bearer", map[string]string{"realm": "a,b", "service": "c"}},
+		{`Bearer realm="unterminated`, "bearer", map[string]string{"realm": "unterminated"}},
+	}
+	for _, test := range tests {
+		scheme, params := parseChallenge(test.header)
+		if scheme != test.scheme || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("parseChallenge(%q) = %q, %v, want %q, %v", test.header, scheme, params, test.scheme, test.params)
+		}
+	}
+}
+
+// registryRef returns a reference to repository of the registry served by server
+func registryRef(t *testing.T, server *httptest.Server, repository string) *Reference {
+	ref, err := ParseReference(strings.TrimPrefix(server.URL, "http://") + "/" + repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func TestTokenAuth(t *testing.T) {
+	var scopes []string
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if ok && (user != "user" || pass != "secret") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("service") != "test-registry" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		scopes = r.URL.Query()["scope"]
+		w.Write([]byte(`{"token":"tok"}`))
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.Header().Set("Www-Authenticate", `Bearer realm="`+server.URL+`/token",service="test-registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("manifest"))
+	})
+
+	ref := registryRef(t, server, "team/app")
+	c, err := newAuthenticatedClient(ref, "pull,push", "team/base", "", "")
+	if err != nil {
+		t.Fatalf("anonymous authentication failed: %v", err)
+	}
+	want := []string{"repository:team/app:pull,push", "repository:team/base:pull"}
+	if !reflect.DeepEqual(scopes, want) {
+		t.Errorf("requested scopes %v, want %v", scopes, want)
+	}
+	resp, err := c.get(context.Background(), "manifests/latest", nil)
+	if err != nil {
+		t.Fatalf("authenticated request failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "manifest" {
+		t.Errorf("got %q, want %q", body, "manifest")
+	}
+
+	if _, err := newAuthenticatedClient(ref, "pull", "", "user", "secret"); err != nil {
+		t.Errorf("authentication with credentials failed: %v", err)
+	}
+	if _, err := newAuthenticatedClient(ref, "pull", "", "user", "wrong"); err == nil || !strings.Contains(err.Error(), "invalid registry credentials") {
+		t.Errorf("authentication with wrong credentials: got %v, want invalid credentials", err)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "secret" {
+			w.Header().Set("Www-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	ref := registryRef(t, server, "app")
+
+	tests := []struct {
+		username, password string
+		err                string
+	}{
+		{"user", "secret", ""},
+		{"user", "wrong", "invalid registry credentials"},
+		{"", "", "use locker login"},
+	}
+	for _, test := range tests {
+		_, err := newAuthenticatedClient(ref, "pull", "", test.username, test.password)
+		if test.err == "" && err != nil {
+			t.Errorf("basic authentication as %q failed: %v", test.username, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("basic authentication as %q: got %v, want an error containing %q", test.username, err, test.err)
+		}
+	}
+}
+
+func TestUnsupportedAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Www-Authenticate", `Negotiate`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	if _, err := newAuthenticatedClient(registryRef(t, server, "app"), "pull", "", "", ""); err == nil {
+		t.Error("authentication with an unsupported scheme succeeded")
+	}
+}
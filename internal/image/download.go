@@ -0,0 +1,128 @@
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	maxDownloadRetries = 5
+	retryBackoff       = time.Second
+)
+
+// isTransient returns true if a failed download is worth retrying
+func isTransient(err error) bool {
+	if statusErr, ok := errors.Cause(err).(*statusError); ok {
+		return statusErr.code >= http.StatusInternalServerError || statusErr.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// partialBlob is a blob being downloaded to a temporary file
+type partialBlob struct {
+	file    *os.File
+	written int64
+	hash    hash.Hash
+}
+
+// downloadBlob downloads blob desc of the repository into the blob store, returns the path of the blob
+// transient failures are retried, resuming from the last byte received if the registry supports ranges
+func (c *registryClient) downloadBlob(ctx context.Context, desc descriptor, id string, reporter progressReporter) (string, error) {
+	path, err := blobPath(desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(blobsDir, 0744); err != nil {
+		return "", errors.Wrap(err, "couldn't create blobs directory")
+	}
+	tmpFile, err := ioutil.TempFile(blobsDir, ".tmp-")
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't create blob file")
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	partial := &partialBlob{file: tmpFile, hash: sha256.New()}
+	for attempt := 1; ; attempt++ {
+		err := c.fetchBlob(ctx, desc, partial, id, reporter)
+		if err == nil {
+			break
+		}
+		if attempt > maxDownloadRetries || !isTransient(err) || ctx.Err() != nil || partial.written > desc.Size {
+			return "", err
+		}
+		reporter.update(progressEvent{ID: id, Status: "Retrying", Current: partial.written, Total: desc.Size})
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Duration(attempt) * retryBackoff):
+		}
+	}
+
+	if partial.written != desc.Size {
+		return "", errors.Errorf("blob %s is corrupted: size is %d, expected %d", desc.Digest, partial.written, desc.Size)
+	}
+	if actual := "sha256:" + hex.EncodeToString(partial.hash.Sum(nil)); actual != desc.Digest {
+		return "", errors.Errorf("blob %s is corrupted: digest mismatch, got %s", desc.Digest, actual)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", errors.Wrapf(err, "couldn't write blob %s", desc.Digest)
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return "", errors.Wrapf(err, "couldn't store blob %s", desc.Digest)
+	}
+	return path, nil
+}
+
+// fetchBlob requests the rest of a partially downloaded blob, and appends it to the partial blob
+func (c *registryClient) fetchBlob(ctx context.Context, desc descriptor, partial *partialBlob, id string, reporter progressReporter) error {
+	headers := make(map[string]string)
+	if partial.written > 0 {
+		headers["Range"] = fmt.Sprintf("bytes=%d-", partial.written)
+	}
+	resp, err := c.get(ctx, "blobs/"+desc.Digest, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// registry ignored the range, start over
+	if partial.written > 0 && resp.StatusCode != http.StatusPartialContent {
+		if err := partial.file.Truncate(0); err != nil {
+			return errors.Wrap(err, "couldn't truncate blob file")
+		}
+		if _, err := partial.file.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrap(err, "couldn't seek blob file")
+		}
+		partial.written = 0
+		partial.hash.Reset()
+	}
+
+	body := &progressReader{
+		r:        io.LimitReader(resp.Body, desc.Size-partial.written+1),
+		reporter: reporter,
+		event:    progressEvent{ID: id, Status: "Downloading", Current: partial.written, Total: desc.Size},
+	}
+	n, err := io.Copy(io.MultiWriter(partial.file, partial.hash), body)
+	partial.written += n
+	if err != nil {
+		return errors.Wrapf(err, "error downloading blob %s", desc.Digest)
+	}
+	if partial.written > desc.Size {
+		return errors.Errorf("blob %s is corrupted: size exceeds expected %d bytes", desc.Digest, desc.Size)
+	}
+	if partial.written < desc.Size {
+		return errors.Errorf("download of blob %s ended after %d of %d bytes", desc.Digest, partial.written, desc.Size)
+	}
+	return nil
+}
@@ -1,23 +1,26 @@
 package image
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"gitlab.com/amit-yuval/locker/internal/mount"
 	"gitlab.com/amit-yuval/locker/internal/utils"
 
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 	"golang.org/x/sys/unix"
 )
 
 // ImageConfig holds the mount point directory for an image
 type ImageConfig struct {
-	Dir string
+	Dir     string
+	volumes []string // mount points of volumes
 }
 
 // ImageMissingError is an error for a missing image
@@ -27,152 +30,340 @@ type ImageMissingError struct {
 
 func (e *ImageMissingError) Error() string { return e.msg }
 
-// MountImage mounts requested image, pulls image if not found locally
-func MountImage(imageName string) (*ImageConfig, error) {
-	layerList, err := getLayerList(imageName)
+// MountImage mounts requested image, pulls it according to pullPolicy (PullMissing, PullAlways or PullNever)
+// hostLayers are host directories mounted read-only above the image layers, the last one on top
+// the container directory is recorded before the image layers are read, so pruning never removes layers in use
+func MountImage(imageName, pullPolicy string, hostLayers []string) (_ *ImageConfig, err error) {
+	ref, err := ParseReference(imageName)
 	if err != nil {
-		if _, ok := err.(*ImageMissingError); ok { // image not found locally
-			fmt.Printf("Unable to find image %s locally\n", imageName)
-			if err := PullImage(imageName); err != nil {
-				return nil, err
-			}
-			layerList, _ = getLayerList(imageName)
+		return nil, err
+	}
+	if hostLayers, err = hostLayerDirs(hostLayers); err != nil {
+		return nil, err
+	}
+	record := containerRecord{Name: viper.GetString("name"), Image: ref.String(), Layers: hostLayers}
+	imageConfig, err := createContainerDir(record)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			imageConfig.Cleanup()
 		}
+	}()
+	baseDir := imageConfig.Dir
+
+	if err := ensureImage(ref, pullPolicy, os.Stdout); err != nil {
+		return nil, err
 	}
-	baseDir, err := ioutil.TempDir(filepath.Join(imagesDir, imageName), "cntr-")
+	layerList, imageDigest, err := useImage(ref)
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating base directory for container")
+		return nil, err
 	}
-	imageConfig := &ImageConfig{
-		Dir: baseDir,
+	// the image the container commits its changes to, even if its tag moves
+	record.ImageDigest = imageDigest
+	if err := writeContainerRecord(baseDir, record); err != nil {
+		return nil, err
 	}
 	if err := createOverlayDirs(baseDir); err != nil {
 		return nil, err
 	}
-	if err := mountLayers(baseDir, layerList); err != nil {
+	if err := mountLayers(baseDir, append(layerList, hostLayers...)); err != nil {
 		return nil, err
 	}
 	return imageConfig, nil
 }
 
-// RemoveImage deletes content of image, updates images data file
-func RemoveImage(imageName string) error {
-	imagesMap, err := getImagesMap()
+// MountRootfs mounts host directory rootfs as the root file system of a container, as the only, read-only,
+// lower layer of an overlay, so changes of the container are removed with it
+// if inPlace, rootfs is mounted as is, and the container changes it
+// hostLayers are host directories mounted read-only above rootfs, the last one on top
+func MountRootfs(rootfs string, inPlace bool, hostLayers []string) (_ *ImageConfig, err error) {
+	if rootfs, err = filepath.Abs(rootfs); err != nil {
+		return nil, errors.Wrap(err, "invalid root file system")
+	}
+	if info, err := os.Stat(rootfs); err != nil {
+		return nil, errors.Wrap(err, "invalid root file system")
+	} else if !info.IsDir() {
+		return nil, errors.Errorf("root file system %s is not a directory", rootfs)
+	}
+	if inPlace && rootfs == "/" {
+		return nil, errors.New("the host root directory can't be used in place")
+	}
+	if inPlace && len(hostLayers) > 0 {
+		return nil, errors.New("layers can't be added to a root file system used in place")
+	}
+	// overlay options are separated by commas, and lower directories by colons
+	if !inPlace && strings.ContainsAny(rootfs, ",:") {
+		return nil, errors.Errorf("root file system %s contains ',' or ':', use it in place", rootfs)
+	}
+	if hostLayers, err = hostLayerDirs(hostLayers); err != nil {
+		return nil, err
+	}
+	imageConfig, err := createContainerDir(containerRecord{Name: viper.GetString("name"), Rootfs: rootfs, Layers: hostLayers})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			imageConfig.Cleanup()
+		}
+	}()
+	if !inPlace {
+		if err := createOverlayDirs(imageConfig.Dir); err != nil {
+			return nil, err
+		}
+		if err := mountLayers(imageConfig.Dir, append([]string{rootfs}, hostLayers...)); err != nil {
+			return nil, err
+		}
+		return imageConfig, nil
+	}
+	mergedDir := filepath.Join(imageConfig.Dir, Merged)
+	if err := os.Mkdir(mergedDir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create directory %s", Merged)
+	}
+	if err := unix.Mount(rootfs, mergedDir, "", unix.MS_BIND, ""); err != nil {
+		return nil, errors.Wrap(err, "unable to mount root file system")
+	}
+	return imageConfig, nil
+}
+
+// hostLayerDirs returns the absolute paths of host directories used as layers, validating they can be overlay layers
+func hostLayerDirs(dirs []string) ([]string, error) {
+	var ret []string
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid layer %s", dir)
+		}
+		if info, err := os.Stat(abs); err != nil {
+			return nil, errors.Wrapf(err, "invalid layer %s", dir)
+		} else if !info.IsDir() {
+			return nil, errors.Errorf("layer %s is not a directory", dir)
+		}
+		// overlay options are separated by commas, and lower directories by colons
+		if strings.ContainsAny(abs, ",:") {
+			return nil, errors.Errorf("layer %s contains ',' or ':'", dir)
+		}
+		ret = append(ret, abs)
+	}
+	return ret, nil
+}
+
+// createContainerDir creates the directory of a new container, with record r
+func createContainerDir(r containerRecord) (*ImageConfig, error) {
+	if err := os.MkdirAll(containersDir, 0744); err != nil {
+		return nil, errors.Wrap(err, "error creating containers directory")
+	}
+	baseDir, err := ioutil.TempDir(containersDir, containerDirPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating base directory for container")
+	}
+	imageConfig := &ImageConfig{
+		Dir: baseDir,
+	}
+	if err := writeContainerRecord(baseDir, r); err != nil {
+		imageConfig.Cleanup()
+		return nil, err
+	}
+	return imageConfig, nil
+}
+
+// RemoveImage removes reference imageName of an image from the image store, returns a report of what was removed
+// the image is deleted with its last reference, its layers and blobs only once no other image uses them,
+// the last reference of an image a running container uses can't be removed
+func RemoveImage(imageName string) (string, error) {
+	ref, err := ParseReference(imageName)
+	if err != nil {
+		return "", err
+	}
+	running, err := runningImages()
+	if err != nil {
+		return "", err
+	}
+	report := ""
+	err = updateStore(func(s *imageStore) error {
+		record, ok := s.get(ref)
+		if !ok {
+			return fmt.Errorf("image %s not found", ref)
+		}
+		if len(s.references(record.imageID())) == 1 && (running[ref.String()] || running[record.ManifestDigest]) {
+			return errors.Errorf("image %s is used by a running container", ref)
+		}
+		delete(s.Images, ref.String())
+		report += fmt.Sprintf("Untagged: %s\n", ref)
+		if len(s.references(record.imageID())) == 0 {
+			report += fmt.Sprintf("Deleted: %s\n", record.imageID())
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return report, collectGarbage()
+}
+
+// TagImage adds reference target to the image of reference source, both share its layers and blobs
+// an image target referenced before keeps its other references
+func TagImage(source, target string) error {
+	ref, err := ParseReference(source)
 	if err != nil {
 		return err
 	}
-	if _, ok := imagesMap[imageName]; !ok {
-		return fmt.Errorf("image %s not found", imageName)
+	targetRef, err := ParseReference(target)
+	if err != nil {
+		return err
+	}
+	if targetRef.Digest != "" {
+		return errors.Errorf("can't tag image as %s, digests are given by the content of images", targetRef)
+	}
+	used, err := containerImages()
+	if err != nil {
+		return err
 	}
-	delete(imagesMap, imageName)
-	if err := updateImagesJson(imagesMap); err != nil {
+	var replaced *imageRecord
+	err = updateStore(func(s *imageStore) error {
+		record, ok := s.get(ref)
+		if !ok {
+			return fmt.Errorf("image %s not found", ref)
+		}
+		tagged := *record
+		tagged.Registry, tagged.Repository, tagged.Tag = targetRef.Registry, targetRef.Repository, targetRef.Tag
+		tagged.Outdated, tagged.Local = false, true
+		s.keepOutdated(targetRef.String(), record.imageID(), used)
+		replaced = s.Images[targetRef.String()]
+		s.Images[targetRef.String()] = &tagged
+		return nil
+	})
+	if err != nil || replaced == nil {
 		return err
 	}
-	imageDir := filepath.Join(imagesDir, imageName)
-	return os.RemoveAll(imageDir)
+	// the image target referenced may have lost its last reference, it is kept as outdated if containers use it
+	return collectGarbage()
 }
 
 // createOverlayDirs creates necessary directories for overlay2 mount
 func createOverlayDirs(baseDir string) error {
+	// the upper directory is the root directory of the container, non root users must be able to traverse it
 	for _, d := range []string{work, upper, Merged} {
-		if err := os.Mkdir(filepath.Join(baseDir, d), 0744); err != nil {
+		if err := os.Mkdir(filepath.Join(baseDir, d), 0755); err != nil {
 			return errors.Wrapf(err, "failed to create directory %s", d)
 		}
 	}
 	return nil
 }
 
+// Stop unmounts image, keeps changes, so the stopped container can be committed until it is pruned
+func (c *ImageConfig) Stop() {
+	for i := len(c.volumes) - 1; i >= 0; i-- {
+		// never unmount through a symlink the container created
+		unix.Unmount(c.volumes[i], unix.UMOUNT_NOFOLLOW)
+	}
+	unix.Unmount(filepath.Join(c.Dir, Merged), 0)
+}
+
+// ID returns the ID of the container the image is mounted for
+func (c *ImageConfig) ID() string {
+	return filepath.Base(c.Dir)
+}
+
 // Cleanup unmounts image, removes changes
 func (c *ImageConfig) Cleanup() {
-	unix.Unmount(filepath.Join(c.Dir, Merged), 0)
+	c.Stop()
+	// never delete through a mount, a root file system used in place would be deleted
+	if mounted, err := mount.MountPoints(c.Dir); err != nil || len(mounted) > 0 {
+		return
+	}
 	os.RemoveAll(c.Dir)
 }
 
 // ListImages returns a string containing list of local images, and data about them
+// shared size is the size of layers used by other images as well, unique size of layers used by this image only
 func ListImages() (string, error) {
-	imagesMap, err := getImagesMap()
+	store, err := readStore()
 	if err != nil {
 		return "", err
 	}
-	ret := utils.Pad(lsPrintPad, " ", "NAME", "SIZE") + "\n"
-	for k := range imagesMap {
-		du, err := utils.DirSize(filepath.Join(imagesDir, k))
+	refCounts := store.layerRefCounts()
+	layerSizes := make(map[string]int64)
+	ret := utils.Pad(lsPrintPad, " ", "REPOSITORY", "TAG", "DIGEST", "SIZE", "SHARED SIZE", "UNIQUE SIZE") + "\n"
+	for _, name := range store.names() {
+		ref, err := ParseReference(name)
 		if err != nil {
-			return "", errors.Wrap(err, "couldn't get disk usage of directory")
+			return "", err
 		}
-		ret += utils.Pad(lsPrintPad, " ", k, bytefmt.ByteSize(uint64(du))) + "\n"
+		layerList, err := store.Images[name].layerDirs()
+		if err != nil {
+			return "", err
+		}
+		var shared, unique int64
+		for _, layer := range layerList {
+			layerSize, ok := layerSizes[layer]
+			if !ok {
+				if layerSize, err = utils.DirSize(layer); err != nil {
+					return "", errors.Wrap(err, "couldn't get disk usage of directory")
+				}
+				layerSizes[layer] = layerSize
+			}
+			if refCounts[layer] > 1 {
+				shared += layerSize
+			} else {
+				unique += layerSize
+			}
+		}
+		ret += utils.Pad(lsPrintPad, " ", ref.FamiliarName(), orNone(ref.Tag), orNone(shortDigest(ref.Digest)),
+			bytefmt.ByteSize(uint64(shared+unique)), bytefmt.ByteSize(uint64(shared)), bytefmt.ByteSize(uint64(unique))) + "\n"
 	}
 	return ret, nil
 }
 
-// mountLayers mounts given layers of image
-func mountLayers(baseDir string, layerList []string) error {
-	opts := fmt.Sprintf("index=off,lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(layerList, ":"), filepath.Join(baseDir, upper), filepath.Join(baseDir, work))
-	if err := unix.Mount("overlay", filepath.Join(baseDir, Merged), "overlay", 0, opts); err != nil {
-		return errors.Wrap(err, "unable to mount image")
+// shortDigest truncates digest for printing
+func shortDigest(digest string) string {
+	if i := strings.Index(digest, ":"); i != -1 && len(digest) > i+1+idPrintLen {
+		return digest[:i+1+idPrintLen]
 	}
-	return nil
+	return digest
 }
 
-// getLayerList returns list of layers of image
-func getLayerList(imageName string) ([]string, error) {
-	imagesMap, err := getImagesMap()
-	if err != nil {
-		return nil, err
-	}
-	layerList, ok := imagesMap[imageName]
-	if !ok {
-		return nil, &ImageMissingError{}
-	}
-
-	return layerList, nil
-}
-
-// getImagesMap returns a map of images to layers
-func getImagesMap() (map[string][]string, error) {
-	jsonFile, err := ioutil.ReadFile(imagesJsonFile)
-	if err != nil {
-		return nil, err
-	}
-	imagesMap := make(map[string][]string)
-	if err := json.Unmarshal(jsonFile, &imagesMap); err != nil {
-		return nil, errors.Wrap(err, "couldn't load images map from json file")
+// orNone returns "<none>" for empty values
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
 	}
-	return imagesMap, nil
+	return s
 }
 
-// updateImagesJson updates images data file with given map
-func updateImagesJson(data map[string][]string) error {
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return errors.Wrap(err, "couldn't marshal json data")
+// mountLayers mounts given layers of image, ordered from the base layer up
+func mountLayers(baseDir string, layerList []string) error {
+	// overlayfs stacks lower directories from right to left, the top layer comes first
+	lowerDirs := make([]string, len(layerList))
+	for i, layer := range layerList {
+		lowerDirs[len(layerList)-1-i] = layer
 	}
-	if err := ioutil.WriteFile(imagesJsonFile, jsonData, 0644); err != nil {
-		return errors.Wrap(err, "couldn't write to images json file")
+	opts := fmt.Sprintf("index=off,lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowerDirs, ":"), filepath.Join(baseDir, upper), filepath.Join(baseDir, work))
+	if err := unix.Mount("overlay", filepath.Join(baseDir, Merged), "overlay", 0, opts); err != nil {
+		return errors.Wrap(err, "unable to mount image")
 	}
 	return nil
 }
 
-// getImageConfig gets config for requested image
-func getImageConfig(imageName string) (map[string]interface{}, error) {
-	jsonFile, err := ioutil.ReadFile(filepath.Join(imagesDir, imageName, configFile))
-	if err != nil {
-		return nil, err
-	}
-	imageConfig := make(map[string]interface{})
-	if err := json.Unmarshal(jsonFile, &imageConfig); err != nil {
-		return nil, errors.Wrap(err, "couldn't load config from json file")
-	}
-	return imageConfig["config"].(map[string]interface{}), nil
-}
-
-// ReadConfigFile returns env, cmdList from config file
-func ReadConfigFile(imageName string) ([]string, []string, error) {
-	imageConfig, err := getImageConfig(imageName)
-	if err != nil {
-		return nil, nil, err
-	}
-	env := utils.InterfaceArrToStrArr(imageConfig["Env"].([]interface{}))
-	cmd := utils.InterfaceArrToStrArr(imageConfig["Cmd"].([]interface{}))
-	return cmd, env, nil
+// useImage returns list of layers of image, ordered from the base layer up, and the digest of its manifest,
+// and records the image was used
+func useImage(ref *Reference) ([]string, string, error) {
+	var (
+		layerList      []string
+		manifestDigest string
+	)
+	err := updateStore(func(s *imageStore) error {
+		record, ok := s.get(ref)
+		if !ok {
+			return &ImageMissingError{msg: fmt.Sprintf("image %s not found", ref)}
+		}
+		record.LastUsed = time.Now().UTC()
+		manifestDigest = record.ManifestDigest
+		var err error
+		layerList, err = record.layerDirs()
+		return err
+	})
+	return layerList, manifestDigest, err
 }
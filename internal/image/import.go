@@ -0,0 +1,199 @@
+package image
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"gitlab.com/amit-yuval/locker/internal/archive"
+
+	"github.com/pkg/errors"
+)
+
+// ImportImage creates a single layer image named imageName from a root file system, returns its image ID
+// source is a directory, or a tar archive (optionally gzip or zstd compressed), "-" reads the archive from stdin
+// changes are Dockerfile instructions setting the Env, Cmd, Entrypoint and WorkingDir of the image
+func ImportImage(source, imageName string, changes []string) (id string, err error) {
+	ref, err := ParseReference(imageName)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return "", errors.Errorf("can't import image %s by digest", ref)
+	}
+	var containerConfig ContainerConfig
+	for _, change := range changes {
+		if err := containerConfig.applyChange(change); err != nil {
+			return "", err
+		}
+	}
+	r, err := openRootfs(source)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	unlockPulls, err := lockPulls(false)
+	if err != nil {
+		return "", err
+	}
+	defer unlockPulls()
+	var created []string
+	defer func() {
+		if err != nil {
+			removeCreated(created)
+		}
+	}()
+
+	layer, diffID, err := createLayerBlob(r, &created)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't import %s", source)
+	}
+	if err := r.Close(); err != nil {
+		return "", errors.Wrapf(err, "couldn't import %s", source)
+	}
+	layerDir, err := layerPath(diffID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(layerDir); err != nil {
+		blob, _ := blobPath(layer.Digest)
+		if _, err := unpackLayer(blob, layer.MediaType, diffID); err != nil {
+			return "", err
+		}
+		created = append(created, layerDir)
+	}
+
+	now := time.Now().UTC()
+	imageConfig := &imageConfigFile{
+		platform: hostPlatform(),
+		Created:  now,
+		Config:   containerConfig,
+		History:  []historyEntry{{Created: now, Comment: "Imported from " + source}},
+	}
+	imageConfig.RootFS.Type = "layers"
+	imageConfig.RootFS.DiffIDs = []string{diffID}
+	confData, err := json.Marshal(imageConfig)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't marshal image config")
+	}
+	m := &manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeDockerManifest,
+		Config:        descriptor{MediaType: mediaTypeDockerConfig, Digest: digestBytes(confData), Size: int64(len(confData))},
+		Layers:        []descriptor{layer},
+	}
+	manifestData, err := json.Marshal(m)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't marshal manifest")
+	}
+	manifestDesc := descriptor{Digest: digestBytes(manifestData), Size: int64(len(manifestData))}
+	if err := createBlob(manifestDesc, manifestData, &created); err != nil {
+		return "", err
+	}
+	if err := createBlob(m.Config, confData, &created); err != nil {
+		return "", err
+	}
+	if err := recordImage(ref, manifestDesc.Digest, manifestDesc.Digest, m, imageConfig, []string{layerDir}, true); err != nil {
+		return "", err
+	}
+	return m.Config.Digest, nil
+}
+
+// openRootfs returns a reader of the uncompressed tar archive of a root file system,
+// of directory source, of tar archive source or of stdin if source is "-"
+func openRootfs(source string) (io.ReadCloser, error) {
+	var f *os.File
+	if source == "-" {
+		f = os.Stdin
+	} else {
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't open root file system")
+		}
+		if info.IsDir() {
+			pr, pw := io.Pipe()
+			go func() {
+				pw.CloseWithError(archive.Create(pw, source))
+			}()
+			return pr, nil
+		}
+		if f, err = os.Open(source); err != nil {
+			return nil, errors.Wrap(err, "couldn't open root file system")
+		}
+	}
+	br := bufio.NewReader(f)
+	tarReader, err := decompress(detectCompression(br), br)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "couldn't decompress %s", source)
+	}
+	return &rootfsReader{ReadCloser: tarReader, file: f}, nil
+}
+
+// rootfsReader reads the uncompressed content of an archive file, closing closes the file as well
+type rootfsReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+// Close closes the decompressor and the archive file, stdin is left open
+func (r *rootfsReader) Close() error {
+	err := r.ReadCloser.Close()
+	if r.file != os.Stdin {
+		r.file.Close()
+	}
+	return err
+}
+
+// createLayerBlob stores the tar archive read from r in the blob store as a gzip layer,
+// returns the descriptor of the blob and the diff ID of the layer, appends the blob to created if it didn't exist before
+func createLayerBlob(r io.Reader, created *[]string) (descriptor, string, error) {
+	layer := descriptor{MediaType: mediaTypeDockerLayerGzip}
+	if err := os.MkdirAll(blobsDir, 0744); err != nil {
+		return layer, "", errors.Wrap(err, "couldn't create blobs directory")
+	}
+	tmpFile, err := ioutil.TempFile(blobsDir, ".tmp-")
+	if err != nil {
+		return layer, "", errors.Wrap(err, "couldn't create blob file")
+	}
+	defer os.Remove(tmpFile.Name())
+	blobHash, diffHash := sha256.New(), sha256.New()
+	gzipWriter := gzip.NewWriter(io.MultiWriter(tmpFile, blobHash))
+	_, err = io.Copy(io.MultiWriter(gzipWriter, diffHash), r)
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return layer, "", errors.Wrap(err, "couldn't write layer blob")
+	}
+	info, err := os.Stat(tmpFile.Name())
+	if err != nil {
+		return layer, "", errors.Wrap(err, "couldn't write layer blob")
+	}
+	layer.Digest = "sha256:" + hex.EncodeToString(blobHash.Sum(nil))
+	layer.Size = info.Size()
+	diffID := "sha256:" + hex.EncodeToString(diffHash.Sum(nil))
+
+	blob, err := blobPath(layer.Digest)
+	if err != nil {
+		return layer, "", err
+	}
+	if _, err := os.Stat(blob); err == nil {
+		return layer, diffID, nil
+	}
+	if err := os.Rename(tmpFile.Name(), blob); err != nil {
+		return layer, "", errors.Wrapf(err, "couldn't store blob %s", layer.Digest)
+	}
+	*created = append(*created, blob)
+	return layer, diffID, nil
+}
@@ -0,0 +1,197 @@
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"gitlab.com/amit-yuval/locker/internal/utils"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/pkg/errors"
+)
+
+// imageInspect is the detailed description of a local image
+type imageInspect struct {
+	Name       string
+	Repository string
+	Tag        string `json:",omitempty"`
+	Digest     string `json:",omitempty"`
+	Id         string // digest of the image config
+	Created    time.Time
+	Pulled     time.Time
+	Author     string `json:",omitempty"`
+	Platform   string `json:",omitempty"`
+	Size       int64  // size of the unpacked layers
+	Config     ContainerConfig
+	Layers     []layerInspect
+	History    []historyEntry `json:",omitempty"`
+	Manifest   *manifest      `json:",omitempty"` // missing for images pulled before manifests were stored
+}
+
+// layerInspect describes a layer of an image
+type layerInspect struct {
+	Digest       string `json:",omitempty"` // digest of the compressed blob
+	MediaType    string `json:",omitempty"`
+	Size         int64  `json:",omitempty"` // size of the compressed blob
+	DiffID       string
+	UnpackedSize int64
+}
+
+// lookupImage returns the reference and store record of a local image
+func lookupImage(imageName string) (*Reference, *imageRecord, error) {
+	ref, err := ParseReference(imageName)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := readStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	record, ok := store.get(ref)
+	if !ok {
+		return nil, nil, &ImageMissingError{msg: fmt.Sprintf("image %s not found", ref)}
+	}
+	return ref, record, nil
+}
+
+// InspectImage returns the description of a local image as JSON,
+// or formatted with the Go template format if given
+func InspectImage(imageName, format string) (string, error) {
+	ref, record, err := lookupImage(imageName)
+	if err != nil {
+		return "", err
+	}
+	imageConfig, err := record.config()
+	if err != nil {
+		return "", err
+	}
+	info := &imageInspect{
+		Name:       ref.String(),
+		Repository: ref.FamiliarName(),
+		Tag:        ref.Tag,
+		Digest:     record.Digest,
+		Id:         record.ConfigDigest,
+		Created:    record.Created,
+		Pulled:     record.Pulled,
+		Author:     imageConfig.Author,
+		Platform:   record.Platform,
+		Size:       record.Size,
+		Config:     imageConfig.Config,
+		History:    imageConfig.History,
+	}
+	if record.ManifestDigest != "" {
+		if info.Manifest, err = readManifestBlob(record.ManifestDigest); err != nil {
+			return "", err
+		}
+	}
+	layerDirs, err := record.layerDirs()
+	if err != nil {
+		return "", err
+	}
+	for i, diffID := range record.DiffIDs {
+		layer := layerInspect{DiffID: diffID}
+		if info.Manifest != nil && i < len(info.Manifest.Layers) {
+			desc := info.Manifest.Layers[i]
+			layer.Digest, layer.MediaType, layer.Size = desc.Digest, desc.MediaType, desc.Size
+		}
+		if layer.UnpackedSize, err = utils.DirSize(layerDirs[i]); err != nil {
+			return "", errors.Wrap(err, "couldn't get disk usage of directory")
+		}
+		info.Layers = append(info.Layers, layer)
+	}
+
+	var out bytes.Buffer
+	if format == "" {
+		enc := json.NewEncoder(&out)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(info); err != nil {
+			return "", errors.Wrap(err, "couldn't encode image description")
+		}
+		return out.String(), nil
+	}
+	tmpl, err := template.New("format").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			out, err := json.Marshal(v)
+			return string(out), err
+		},
+		"join": strings.Join,
+	}).Parse(format)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid format")
+	}
+	if err := tmpl.Execute(&out, info); err != nil {
+		return "", errors.Wrap(err, "couldn't format image description")
+	}
+	return out.String() + "\n", nil
+}
+
+// ImageHistory returns a string listing the history of a local image, newest step first
+// each step shows the layer it created and its size, steps which changed the config only have no layer
+func ImageHistory(imageName string) (string, error) {
+	_, record, err := lookupImage(imageName)
+	if err != nil {
+		return "", err
+	}
+	imageConfig, err := record.config()
+	if err != nil {
+		return "", err
+	}
+	layerDirs, err := record.layerDirs()
+	if err != nil {
+		return "", err
+	}
+	history := imageConfig.History
+	if len(history) == 0 {
+		// images without history, one unknown step per layer
+		history = make([]historyEntry, len(record.DiffIDs))
+	}
+
+	var rows []string
+	layer := 0
+	for _, entry := range history {
+		id, size := "<none>", "0B"
+		if !entry.EmptyLayer && layer < len(record.DiffIDs) {
+			layerSize, err := utils.DirSize(layerDirs[layer])
+			if err != nil {
+				return "", errors.Wrap(err, "couldn't get disk usage of directory")
+			}
+			id, size = shortDigest(record.DiffIDs[layer]), bytefmt.ByteSize(uint64(layerSize))
+			layer++
+		}
+		created := ""
+		if !entry.Created.IsZero() {
+			created = entry.Created.Local().Format(historyTimeFormat)
+		}
+		rows = append(rows, utils.Pad(lsPrintPad, " ", id, orMissing(created))+
+			utils.Pad(historyCreatedByPad, " ", orMissing(truncate(strings.Join(strings.Fields(entry.CreatedBy), " "), historyCreatedByPad-1)))+
+			utils.Pad(lsPrintPad, " ", size, entry.Comment)+"\n")
+	}
+
+	ret := utils.Pad(lsPrintPad, " ", "LAYER", "CREATED") + utils.Pad(historyCreatedByPad, " ", "CREATED BY") + utils.Pad(lsPrintPad, " ", "SIZE", "COMMENT") + "\n"
+	for i := len(rows) - 1; i >= 0; i-- {
+		ret += rows[i]
+	}
+	return ret, nil
+}
+
+// orMissing returns "<missing>" for empty values
+func orMissing(s string) string {
+	if s == "" {
+		return "<missing>"
+	}
+	return s
+}
+
+// truncate shortens s to length characters for printing
+func truncate(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+	return string(runes[:length-3]) + "..."
+}
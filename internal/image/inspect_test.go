@@ -0,0 +1,22 @@
+package image
+
+import "testing"
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		in     string
+		length int
+		want   string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"longer than ten", 10, "longer ..."},
+		{"שלום עולם, מה שלומך", 10, "שלום עו..."},
+		{"日本語のコマンドです", 8, "日本語のコ..."},
+	}
+	for _, test := range tests {
+		if got := truncate(test.in, test.length); got != test.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", test.in, test.length, got, test.want)
+		}
+	}
+}
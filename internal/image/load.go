@@ -0,0 +1,467 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	lockerio "gitlab.com/amit-yuval/locker/pkg/io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// archiveReader loads the images of an archive extracted to dir
+type archiveReader struct {
+	dir     string
+	created *[]string         // paths created in the layer and blob stores
+	blobs   map[string]string // archive files moved to the blob store, by path
+	descs   map[string]descriptor
+}
+
+// LoadImages loads the images of a tar archive read from r, in the OCI image layout or the layout of docker save,
+// optionally compressed, and registers them in the image store as PullImage does, returns their references
+// an OCI image index of several platforms loads the image of the requested platform
+func LoadImages(r io.Reader) (names []string, err error) {
+	unlockPulls, err := lockPulls(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockPulls()
+	tmpDir, err := ioutil.TempDir(imagesDir, ".load-")
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create archive directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	br := bufio.NewReader(r)
+	tarReader, err := decompress(detectCompression(br), br)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't decompress archive")
+	}
+	defer tarReader.Close()
+	if err := extractArchive(tarReader, tmpDir); err != nil {
+		return nil, err
+	}
+	if err := tarReader.Close(); err != nil {
+		return nil, errors.Wrap(err, "couldn't decompress archive")
+	}
+
+	var created []string
+	defer func() {
+		if err != nil {
+			removeCreated(created)
+		}
+	}()
+	a := &archiveReader{dir: tmpDir, created: &created, blobs: make(map[string]string), descs: make(map[string]descriptor)}
+	if _, err := os.Stat(filepath.Join(tmpDir, archiveManifestFile)); err == nil {
+		return a.loadDockerArchive()
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, ociLayoutFile)); err == nil {
+		return a.loadOCILayout()
+	}
+	return nil, errors.New("archive is neither a docker archive nor an OCI image layout")
+}
+
+// extractArchive extracts the directories, regular files and symlinks of a tar archive to dir
+// files are extracted without their permissions, for locker only
+func extractArchive(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "couldn't read archive")
+		}
+		target, err := lockerio.ScopedJoin(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		// an entry replaces an earlier one, so files are never written through archive symlinks
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return errors.Wrapf(err, "couldn't extract %s from archive", hdr.Name)
+			}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0700)
+		case tar.TypeReg, tar.TypeRegA:
+			if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				break
+			}
+			var f *os.File
+			if f, err = os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY|unix.O_NOFOLLOW, 0600); err != nil {
+				break
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		case tar.TypeSymlink:
+			if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				break
+			}
+			err = os.Symlink(hdr.Linkname, target)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "couldn't extract %s from archive", hdr.Name)
+		}
+	}
+}
+
+// filePath returns the path of regular file name of the archive, symlinks of the archive are resolved inside of it
+func (a *archiveReader) filePath(name string) (string, error) {
+	p, err := lockerio.ScopedResolve(a.dir, name)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't read %s from archive", name)
+	}
+	if !fi.Mode().IsRegular() {
+		return "", errors.Errorf("%s of the archive is not a regular file", name)
+	}
+	return p, nil
+}
+
+// readFile returns the content of a file of the archive
+func (a *archiveReader) readFile(name string) ([]byte, error) {
+	p, err := a.filePath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read %s from archive", name)
+	}
+	return data, nil
+}
+
+// readBlob returns the content of a blob of an OCI image layout, verified against desc
+func (a *archiveReader) readBlob(desc descriptor) ([]byte, error) {
+	hex, err := digestHex(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := a.readFile(path.Join(ociBlobsDir, hex))
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyBytes(data, desc.Digest, desc.Size); err != nil {
+		return nil, errors.Wrapf(err, "blob %s is corrupted", desc.Digest)
+	}
+	return data, nil
+}
+
+// storeFile moves a file of the archive into the blob store, returns its blob and its descriptor with mediaType
+// the file is verified against digest and size of desc, or they are computed if desc has no digest
+func (a *archiveReader) storeFile(name string, desc descriptor) (string, descriptor, error) {
+	p, err := lockerio.ScopedResolve(a.dir, name)
+	if err != nil {
+		return "", desc, err
+	}
+	if blob, ok := a.blobs[p]; ok {
+		stored := a.descs[p]
+		stored.MediaType = desc.MediaType
+		return blob, stored, nil
+	}
+	if desc.Digest != "" {
+		if blob, err := blobPath(desc.Digest); err != nil {
+			return "", desc, err
+		} else if _, err := os.Stat(blob); err == nil {
+			return blob, desc, nil
+		}
+	}
+	// only regular files are stored, so neither links nor anything outside the archive end up in the blob store
+	if _, err := a.filePath(name); err != nil {
+		return "", desc, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return "", desc, errors.Wrapf(err, "couldn't read %s from archive", name)
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return "", desc, errors.Wrapf(err, "couldn't read %s from archive", name)
+	}
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if desc.Digest == "" {
+		desc.Digest, desc.Size = digest, size
+	} else if digest != desc.Digest || size != desc.Size {
+		return "", desc, errors.Errorf("blob %s is corrupted", desc.Digest)
+	}
+	blob, err := blobPath(desc.Digest)
+	if err != nil {
+		return "", desc, err
+	}
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := os.MkdirAll(blobsDir, 0744); err != nil {
+			return "", desc, errors.Wrap(err, "couldn't create blobs directory")
+		}
+		if err := os.Rename(p, blob); err != nil {
+			return "", desc, errors.Wrapf(err, "couldn't store blob %s", desc.Digest)
+		}
+		*a.created = append(*a.created, blob)
+	}
+	a.blobs[p], a.descs[p] = blob, desc
+	return blob, desc, nil
+}
+
+// unpackLayers unpacks the layer blobs of an image into the layer store, returns the layer directories
+func (a *archiveReader) unpackLayers(m *manifest, blobs []string, diffIDs []string) ([]string, error) {
+	var layerList []string
+	for i, layer := range m.Layers {
+		layerDir, err := layerPath(diffIDs[i])
+		if err != nil {
+			return nil, err
+		}
+		layerList = append(layerList, layerDir)
+		if _, err := os.Stat(layerDir); err == nil {
+			continue
+		}
+		if _, err := unpackLayer(blobs[i], layer.MediaType, diffIDs[i]); err != nil {
+			return nil, err
+		}
+		*a.created = append(*a.created, layerDir)
+	}
+	return layerList, nil
+}
+
+// storeImage stores the manifest and config of an image in the blob store, and records it by refs
+func (a *archiveReader) storeImage(refs []*Reference, refDigest string, manifestData, confData []byte, m *manifest, imageConfig *imageConfigFile, layerList []string) ([]string, error) {
+	manifestDesc := descriptor{Digest: digestBytes(manifestData), Size: int64(len(manifestData))}
+	if err := createBlob(manifestDesc, manifestData, a.created); err != nil {
+		return nil, err
+	}
+	if err := createBlob(m.Config, confData, a.created); err != nil {
+		return nil, err
+	}
+	if refDigest == "" {
+		refDigest = manifestDesc.Digest
+	}
+	var names []string
+	for _, ref := range refs {
+		if err := recordImage(ref, refDigest, manifestDesc.Digest, m, imageConfig, layerList, true); err != nil {
+			return nil, err
+		}
+		names = append(names, ref.String())
+	}
+	return names, nil
+}
+
+// readArchiveConfig parses an image config, and checks it matches the layers of m
+func readArchiveConfig(confData []byte, m *manifest) (*imageConfigFile, error) {
+	var imageConfig imageConfigFile
+	if err := json.Unmarshal(confData, &imageConfig); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse image config")
+	}
+	if len(imageConfig.RootFS.DiffIDs) != len(m.Layers) {
+		return nil, errors.New("image config doesn't match its layers")
+	}
+	return &imageConfig, nil
+}
+
+// loadDockerArchive loads the images listed in the manifest.json file of a docker archive
+// a manifest is created for each image, with the layers of the archive as its layer blobs
+func (a *archiveReader) loadDockerArchive() ([]string, error) {
+	data, err := a.readFile(archiveManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	var entries []archiveManifest
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse archive manifest")
+	}
+	var names []string
+	for _, entry := range entries {
+		if len(entry.RepoTags) == 0 {
+			return nil, errors.Errorf("image %s of archive has no name", entry.Config)
+		}
+		var refs []*Reference
+		for _, tag := range entry.RepoTags {
+			ref, err := ParseReference(tag)
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, ref)
+		}
+		confData, err := a.readFile(entry.Config)
+		if err != nil {
+			return nil, err
+		}
+		m := &manifest{
+			SchemaVersion: 2,
+			MediaType:     mediaTypeDockerManifest,
+			Config:        descriptor{MediaType: mediaTypeDockerConfig, Digest: digestBytes(confData), Size: int64(len(confData))},
+		}
+
+		// layers are usually uncompressed, zstd layers can only be described by an OCI manifest
+		compressions := make([]compression, len(entry.Layers))
+		oci := false
+		for i, name := range entry.Layers {
+			p, err := a.filePath(name)
+			if err != nil {
+				return nil, err
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return nil, errors.Wrapf(err, "couldn't read %s from archive", name)
+			}
+			compressions[i] = detectCompression(bufio.NewReader(f))
+			f.Close()
+			oci = oci || compressions[i] == zstdCompressed
+		}
+		if oci {
+			m.MediaType, m.Config.MediaType = mediaTypeOCIManifest, mediaTypeOCIConfig
+		}
+		var blobs []string
+		for i, name := range entry.Layers {
+			blob, desc, err := a.storeFile(name, descriptor{MediaType: layerMediaType(compressions[i], oci)})
+			if err != nil {
+				return nil, err
+			}
+			m.Layers = append(m.Layers, desc)
+			blobs = append(blobs, blob)
+		}
+		if err := m.validate(); err != nil {
+			return nil, errors.Wrapf(err, "couldn't load %s", refs[0])
+		}
+		imageConfig, err := readArchiveConfig(confData, m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't load %s", refs[0])
+		}
+		layerList, err := a.unpackLayers(m, blobs, imageConfig.RootFS.DiffIDs)
+		if err != nil {
+			return nil, err
+		}
+		manifestData, err := json.Marshal(m)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't marshal manifest")
+		}
+		loaded, err := a.storeImage(refs, "", manifestData, confData, m, imageConfig, layerList)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, loaded...)
+	}
+	return names, nil
+}
+
+// loadOCILayout loads the images named in the index.json file of an OCI image layout
+func (a *archiveReader) loadOCILayout() ([]string, error) {
+	data, err := a.readFile(ociLayoutFile)
+	if err != nil {
+		return nil, err
+	}
+	var layout ociLayout
+	if err := json.Unmarshal(data, &layout); err != nil || layout.ImageLayoutVersion == "" {
+		return nil, errors.New("invalid oci-layout file")
+	}
+	if data, err = a.readFile(ociIndexFile); err != nil {
+		return nil, err
+	}
+	var index manifestList
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse image index")
+	}
+	wantPlatform, explicitPlatform, err := requestedPlatform()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, desc := range index.Manifests {
+		ref, err := ociImageName(desc)
+		if err != nil {
+			return nil, err
+		}
+		manifestData, err := a.readBlob(desc.descriptor)
+		if err != nil {
+			return nil, err
+		}
+		if isManifestList(desc.MediaType) {
+			var list manifestList
+			if err := json.Unmarshal(manifestData, &list); err != nil {
+				return nil, errors.Wrap(err, "couldn't parse manifest list")
+			}
+			selected, err := list.selectManifest(wantPlatform)
+			if err != nil {
+				return nil, errors.Wrapf(err, "couldn't load %s", ref)
+			}
+			if manifestData, err = a.readBlob(selected); err != nil {
+				return nil, err
+			}
+		}
+		var m manifest
+		if err := json.Unmarshal(manifestData, &m); err != nil {
+			return nil, errors.Wrap(err, "couldn't parse manifest")
+		}
+		if err := m.validate(); err != nil {
+			return nil, errors.Wrapf(err, "couldn't load %s", ref)
+		}
+		confData, err := a.readBlob(m.Config)
+		if err != nil {
+			return nil, err
+		}
+		imageConfig, err := readArchiveConfig(confData, &m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't load %s", ref)
+		}
+		imagePlatform := imageConfig.platform.normalize()
+		if explicitPlatform && !wantPlatform.matches(imagePlatform) {
+			return nil, errors.Errorf("image %s is built for platform %s, requested %s", ref, imagePlatform, wantPlatform)
+		}
+		var blobs []string
+		for _, layer := range m.Layers {
+			hex, err := digestHex(layer.Digest)
+			if err != nil {
+				return nil, err
+			}
+			blob, _, err := a.storeFile(path.Join(ociBlobsDir, hex), layer)
+			if err != nil {
+				return nil, err
+			}
+			blobs = append(blobs, blob)
+		}
+		layerList, err := a.unpackLayers(&m, blobs, imageConfig.RootFS.DiffIDs)
+		if err != nil {
+			return nil, err
+		}
+		loaded, err := a.storeImage([]*Reference{ref}, desc.Digest, manifestData, confData, &m, imageConfig, layerList)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, loaded...)
+	}
+	return names, nil
+}
+
+// ociImageName returns the reference of an image of an OCI image index, from its annotations
+// a ref name holding only a tag doesn't name the image
+func ociImageName(desc platformDescriptor) (*Reference, error) {
+	name := desc.Annotations[annotationImageName]
+	if refName := desc.Annotations[annotationRefName]; name == "" && strings.ContainsAny(refName, ":/@") {
+		name = refName
+	}
+	if name == "" {
+		return nil, errors.Errorf("image %s of archive has no name", desc.Digest)
+	}
+	ref, err := ParseReference(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid name of image %s of archive", desc.Digest)
+	}
+	return ref, nil
+}
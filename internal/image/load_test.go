@@ -0,0 +1,85 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// archiveEntry is an entry of a test archive, a symlink if linkname is set
+type archiveEntry struct {
+	name, linkname, content string
+}
+
+// testArchive returns a tar archive of entries
+func testArchive(t *testing.T, entries ...archiveEntry) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e.content))}
+		if e.linkname != "" {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.linkname, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestExtractArchiveSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "load-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	if err := ioutil.WriteFile(outside, []byte("host file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	archiveDir := filepath.Join(dir, "archive")
+
+	err = extractArchive(testArchive(t,
+		archiveEntry{name: "a", linkname: outside},
+		archiveEntry{name: "a", content: "archive file"},
+		archiveEntry{name: "b", linkname: "../outside"},
+		archiveEntry{name: "c", linkname: outside},
+		archiveEntry{name: "layer.tar", content: "layer"},
+		archiveEntry{name: "dup/layer.tar", linkname: "../layer.tar"},
+	), archiveDir)
+	if err != nil {
+		t.Fatalf("extractArchive failed: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(outside); string(data) != "host file" {
+		t.Errorf("file outside of the archive was overwritten with %q", data)
+	}
+
+	a := &archiveReader{dir: archiveDir, blobs: make(map[string]string), descs: make(map[string]descriptor)}
+	tests := []struct {
+		name string
+		want string // content, empty if reading must fail
+	}{
+		{"a", "archive file"},
+		{"b", ""},
+		{"c", ""},
+		{"dup/layer.tar", "layer"},
+		{".", ""},
+	}
+	for _, test := range tests {
+		data, err := a.readFile(test.name)
+		if test.want == "" && err == nil {
+			t.Errorf("reading %s of the archive returned %q, want an error", test.name, data)
+		} else if test.want != "" && string(data) != test.want {
+			t.Errorf("reading %s of the archive returned %q, %v, want %q", test.name, data, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package image
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// lockerfileFlags are the flags each Lockerfile instruction takes
+var lockerfileFlags = map[string][]string{
+	"FROM":       nil,
+	"RUN":        nil,
+	"COPY":       {"from", "chown"},
+	"ADD":        {"chown"},
+	"ENV":        nil,
+	"WORKDIR":    nil,
+	"USER":       nil,
+	"ENTRYPOINT": nil,
+	"CMD":        nil,
+	"LABEL":      nil,
+}
+
+// lockerfileInstruction is an instruction of a Lockerfile, a subset of the Dockerfile syntax
+type lockerfileInstruction struct {
+	line  int               // line the instruction starts at
+	text  string            // the instruction, as written
+	cmd   string            // keyword, upper case
+	flags map[string]string // --NAME=VALUE flags preceding the arguments
+	args  string
+}
+
+// parseLockerfile parses the instructions of a Lockerfile read from r
+// lines starting with # are comments, a line ending with \ continues on the next line
+func parseLockerfile(r io.Reader) ([]*lockerfileInstruction, error) {
+	var (
+		instructions []*lockerfileInstruction
+		current      strings.Builder
+		start        int
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRightFunc(scanner.Text(), unicode.IsSpace)
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if current.Len() == 0 {
+			start = line
+		}
+		if strings.HasSuffix(text, "\\") {
+			current.WriteString(strings.TrimSuffix(text, "\\"))
+			continue
+		}
+		current.WriteString(text)
+		instruction, err := parseInstruction(current.String(), start)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, instruction)
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "couldn't read Lockerfile")
+	}
+	if current.Len() > 0 {
+		instruction, err := parseInstruction(current.String(), start)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, instruction)
+	}
+	return instructions, nil
+}
+
+// parseInstruction parses an instruction starting at line
+func parseInstruction(text string, line int) (*lockerfileInstruction, error) {
+	text = strings.TrimSpace(text)
+	cmd, rest := splitFirstWord(text)
+	cmd = strings.ToUpper(cmd)
+	allowed, ok := lockerfileFlags[cmd]
+	if !ok {
+		return nil, errors.Errorf("line %d: unsupported instruction %s", line, cmd)
+	}
+	instruction := &lockerfileInstruction{line: line, text: text, cmd: cmd, flags: make(map[string]string)}
+	for strings.HasPrefix(rest, "--") {
+		var flag string
+		flag, rest = splitFirstWord(rest)
+		kv := strings.SplitN(strings.TrimPrefix(flag, "--"), "=", 2)
+		known := false
+		for _, name := range allowed {
+			known = known || name == kv[0]
+		}
+		if !known || len(kv) != 2 {
+			return nil, errors.Errorf("line %d: unknown flag %s of %s", line, flag, cmd)
+		}
+		instruction.flags[kv[0]] = kv[1]
+	}
+	if rest == "" {
+		return nil, errors.Errorf("line %d: %s needs arguments", line, cmd)
+	}
+	instruction.args = rest
+	return instruction, nil
+}
+
+// splitFirstWord splits s at its first whitespace, returns the first word and the trimmed rest
+func splitFirstWord(s string) (string, string) {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i == -1 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
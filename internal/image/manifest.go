@@ -0,0 +1,147 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIConfig          = "application/vnd.oci.image.config.v1+json"
+)
+
+// descriptor describes a blob referenced by a manifest
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// manifest is an image manifest, lists the config and layer blobs of an image
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+// validate checks that m is an image manifest, and that locker can unpack all of its layers
+func (m *manifest) validate() error {
+	if m.SchemaVersion != 2 {
+		return errors.Errorf("unsupported manifest schema version %d", m.SchemaVersion)
+	}
+	switch m.MediaType {
+	case "", mediaTypeDockerManifest, mediaTypeOCIManifest:
+	default:
+		return errors.Errorf("unsupported manifest media type %s", m.MediaType)
+	}
+	switch m.Config.MediaType {
+	case "", mediaTypeDockerConfig, mediaTypeOCIConfig:
+	default:
+		return errors.Errorf("manifest is not of a container image, config media type is %s", m.Config.MediaType)
+	}
+	if m.Config.Digest == "" || len(m.Layers) == 0 {
+		return errors.New("manifest has no config or layers")
+	}
+	return checkLayers(m.Layers)
+}
+
+// manifestList is a manifest list (or OCI image index), lists manifests of an image for several platforms
+type manifestList struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType,omitempty"`
+	Manifests     []platformDescriptor `json:"manifests"`
+}
+
+// platformDescriptor describes a manifest of a manifest list, and the platform it is built for
+type platformDescriptor struct {
+	descriptor
+	Platform    *platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// isManifestList returns true if mediaType is of a manifest list or OCI image index
+func isManifestList(mediaType string) bool {
+	return mediaType == mediaTypeDockerManifestList || mediaType == mediaTypeOCIIndex
+}
+
+// selectManifest returns the descriptor of the manifest of list matching requested platform
+func (l *manifestList) selectManifest(p platform) (descriptor, error) {
+	var available []string
+	for _, m := range l.Manifests {
+		if m.Platform == nil {
+			continue
+		}
+		if p.matches(*m.Platform) {
+			return m.descriptor, nil
+		}
+		available = append(available, m.Platform.String())
+	}
+	return descriptor{}, errors.Errorf("no image for platform %s, available platforms: %s", p, strings.Join(available, ", "))
+}
+
+// digestBytes returns the sha256 digest of data
+func digestBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// verifyBytes checks that data matches given digest and size, a negative size is not checked
+func verifyBytes(data []byte, digest string, size int64) error {
+	if size >= 0 && int64(len(data)) != size {
+		return errors.Errorf("size of %s is %d, expected %d", digest, len(data), size)
+	}
+	if actual := digestBytes(data); actual != digest {
+		return errors.Errorf("digest mismatch, expected %s got %s", digest, actual)
+	}
+	return nil
+}
+
+// verifier is a reader that hashes and counts content as it is read,
+// the content is checked against the expected digest and size once fully read
+type verifier struct {
+	r      io.Reader
+	hash   hash.Hash
+	digest string
+	size   int64 // expected size, negative if unknown
+	read   int64
+}
+
+// newVerifier returns a verifier of r, reads at most size+1 bytes so oversized content is detected
+func newVerifier(r io.Reader, digest string, size int64) *verifier {
+	if size >= 0 {
+		r = io.LimitReader(r, size+1)
+	}
+	return &verifier{r: r, hash: sha256.New(), digest: digest, size: size}
+}
+
+// Read reads from the underlying reader, hashing the content read
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	v.read += int64(n)
+	if v.size >= 0 && v.read > v.size {
+		return n, errors.Errorf("size of %s exceeds expected %d bytes", v.digest, v.size)
+	}
+	return n, err
+}
+
+// verify checks content read so far against the expected digest and size
+func (v *verifier) verify() error {
+	if v.size >= 0 && v.read != v.size {
+		return errors.Errorf("size of %s is %d, expected %d", v.digest, v.read, v.size)
+	}
+	if actual := "sha256:" + hex.EncodeToString(v.hash.Sum(nil)); actual != v.digest {
+		return errors.Errorf("digest mismatch, expected %s got %s", v.digest, actual)
+	}
+	return nil
+}
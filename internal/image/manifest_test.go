@@ -0,0 +1,93 @@
+package image
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestVerifier(t *testing.T) {
+	content := []byte("layer content")
+	digest := digestBytes(content)
+	tests := []struct {
+		name    string
+		content []byte
+		digest  string
+		size    int64
+		ok      bool
+	}{
+		{"matching", content, digest, int64(len(content)), true},
+		{"unknown size", content, digest, -1, true},
+		{"corrupted", []byte("layer c0ntent"), digest, int64(len(content)), false},
+		{"truncated", content[:5], digest, int64(len(content)), false},
+		{"oversized", append(content, '!'), digest, int64(len(content)), false},
+		{"wrong size", content, digest, int64(len(content)) - 1, false},
+		{"wrong digest", content, digestBytes([]byte("other")), int64(len(content)), false},
+	}
+	for _, test := range tests {
+		v := newVerifier(bytes.NewReader(test.content), test.digest, test.size)
+		_, err := io.Copy(ioutil.Discard, v)
+		if err == nil {
+			err = v.verify()
+		}
+		if test.ok && err != nil {
+			t.Errorf("%s: verification failed: %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: verification succeeded", test.name)
+		}
+
+		err = verifyBytes(test.content, test.digest, test.size)
+		if test.ok && err != nil {
+			t.Errorf("%s: verifyBytes failed: %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: verifyBytes succeeded", test.name)
+		}
+	}
+}
+
+func TestSelectManifest(t *testing.T) {
+	entry := func(digest string, p *platform) platformDescriptor {
+		return platformDescriptor{descriptor: descriptor{Digest: digest}, Platform: p}
+	}
+	list := manifestList{Manifests: []platformDescriptor{
+		entry("attestation", nil),
+		entry("amd64", &platform{OS: "linux", Architecture: "amd64"}),
+		entry("armv6", &platform{OS: "linux", Architecture: "arm", Variant: "v6"}),
+		entry("armv7", &platform{OS: "linux", Architecture: "arm", Variant: "v7"}),
+		entry("arm64", &platform{OS: "linux", Architecture: "arm64", Variant: "v8"}),
+		entry("windows", &platform{OS: "windows", Architecture: "amd64"}),
+	}}
+	tests := []struct {
+		platform string
+		digest   string
+	}{
+		{"linux/amd64", "amd64"},
+		{"linux/x86_64", "amd64"},
+		{"linux/arm/v7", "armv7"},
+		{"linux/arm", "armv6"},
+		{"linux/aarch64", "arm64"},
+		{"linux/arm64", "arm64"},
+		{"windows/amd64", "windows"},
+		{"linux/s390x", ""},
+		{"linux/arm/v5", ""},
+	}
+	for _, test := range tests {
+		p, err := parsePlatform(test.platform)
+		if err != nil {
+			t.Fatalf("parsePlatform(%q) failed: %v", test.platform, err)
+		}
+		desc, err := list.selectManifest(p)
+		switch {
+		case test.digest == "" && err == nil:
+			t.Errorf("platform %s selected %s, want no manifest", test.platform, desc.Digest)
+		case test.digest == "" && !strings.Contains(err.Error(), "linux/arm64/v8"):
+			t.Errorf("platform %s: error %q doesn't list available platforms", test.platform, err)
+		case test.digest != "" && err != nil:
+			t.Errorf("platform %s: %v", test.platform, err)
+		case test.digest != "" && desc.Digest != test.digest:
+			t.Errorf("platform %s selected %s, want %s", test.platform, desc.Digest, test.digest)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package image
+
+import (
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+)
+
+// armMachineRegexp matches the machine names of 32-bit arm kernels, e.g. armv6l, armv7l or armv5tejl
+var armMachineRegexp = regexp.MustCompile(`^armv([0-9]+)`)
+
+// platform is the operating system and cpu architecture an image runs on
+type platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String returns the platform in its os/arch[/variant] form
+func (p platform) String() string {
+	ret := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		ret += "/" + p.Variant
+	}
+	return ret
+}
+
+// normalize returns the platform with architecture aliases replaced by their canonical names
+func (p platform) normalize() platform {
+	p.OS = strings.ToLower(p.OS)
+	p.Architecture = strings.ToLower(p.Architecture)
+	switch p.Architecture {
+	case "x86_64", "x86-64":
+		p.Architecture = "amd64"
+	case "i386", "i686":
+		p.Architecture = "386"
+	case "aarch64":
+		p.Architecture = "arm64"
+		if p.Variant == "" {
+			p.Variant = "v8"
+		}
+	case "armhf":
+		p.Architecture, p.Variant = "arm", "v7"
+	case "armel":
+		p.Architecture, p.Variant = "arm", "v6"
+	}
+	if p.Architecture == "arm64" && p.Variant == "" {
+		p.Variant = "v8"
+	}
+	return p
+}
+
+// matches returns true if an image of platform other runs on p, an empty variant of p matches any variant
+func (p platform) matches(other platform) bool {
+	p, other = p.normalize(), other.normalize()
+	if p.OS != other.OS || p.Architecture != other.Architecture {
+		return false
+	}
+	return p.Variant == "" || p.Variant == other.Variant
+}
+
+// parsePlatform parses a platform of the form os/arch[/variant]
+func parsePlatform(s string) (platform, error) {
+	split := strings.Split(s, "/")
+	if len(split) < 2 || len(split) > 3 || split[0] == "" || split[1] == "" {
+		return platform{}, errors.Errorf("invalid platform %q, expected os/arch[/variant]", s)
+	}
+	p := platform{OS: split[0], Architecture: split[1]}
+	if len(split) == 3 {
+		p.Variant = split[2]
+	}
+	return p.normalize(), nil
+}
+
+// hostPlatform returns the platform locker runs on
+func hostPlatform() platform {
+	p := platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	if p.Architecture == "arm" {
+		var uts unix.Utsname
+		if err := unix.Uname(&uts); err == nil {
+			p.Variant = armVariant(strings.TrimRight(string(uts.Machine[:]), "\x00"))
+		}
+	}
+	return p.normalize()
+}
+
+// armVariant returns the variant of 32-bit arm images a machine (e.g. armv6l) runs, empty if unknown so any variant matches
+// 32-bit arm images have no variant newer than v7, which armv8 machines run
+func armVariant(machine string) string {
+	match := armMachineRegexp.FindStringSubmatch(machine)
+	if match == nil {
+		return ""
+	}
+	if version, _ := strconv.Atoi(match[1]); version >= 7 {
+		return "v7"
+	}
+	return "v" + match[1]
+}
+
+// requestedPlatform returns the platform given by the platform flag, defaults to the host platform
+// explicit is true if the platform flag was given
+func requestedPlatform() (p platform, explicit bool, err error) {
+	if s := viper.GetString("platform"); s != "" {
+		p, err = parsePlatform(s)
+		return p, true, err
+	}
+	return hostPlatform(), false, nil
+}
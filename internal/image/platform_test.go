@@ -0,0 +1,34 @@
+package image
+
+import "testing"
+
+func TestArmVariant(t *testing.T) {
+	tests := []struct {
+		machine, want string
+	}{
+		{"armv5tejl", "v5"},
+		{"armv6l", "v6"},
+		{"armv7l", "v7"},
+		{"armv8l", "v7"},
+		{"aarch64", ""},
+		{"arm", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := armVariant(test.machine); got != test.want {
+			t.Errorf("armVariant(%q) = %q, want %q", test.machine, got, test.want)
+		}
+	}
+
+	// an armv6 host doesn't select v7 images, a host of unknown variant selects any
+	list := manifestList{Manifests: []platformDescriptor{
+		{descriptor: descriptor{Digest: "armv7"}, Platform: &platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{descriptor: descriptor{Digest: "armv6"}, Platform: &platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+	}}
+	for machine, want := range map[string]string{"armv6l": "armv6", "armv7l": "armv7", "arm": "armv7"} {
+		p := platform{OS: "linux", Architecture: "arm", Variant: armVariant(machine)}
+		if desc, err := list.selectManifest(p); err != nil || desc.Digest != want {
+			t.Errorf("%s host selected %q, %v, want %q", machine, desc.Digest, err, want)
+		}
+	}
+}
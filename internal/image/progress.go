@@ -0,0 +1,152 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lockerio "gitlab.com/amit-yuval/locker/pkg/io"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	progressInterval = 100 * time.Millisecond
+	progressBarWidth = 40
+)
+
+// progressEvent is a status update of a pull, ID is empty for updates of the whole pull
+type progressEvent struct {
+	ID      string `json:"id,omitempty"`
+	Status  string `json:"status"`
+	Current int64  `json:"current,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+}
+
+// progressReporter prints progress events
+type progressReporter interface {
+	update(e progressEvent)
+}
+
+// newProgressReporter returns the reporter requested by the progress flag, "auto" picks "tty" if stdout is a terminal
+func newProgressReporter() (progressReporter, error) {
+	mode := viper.GetString("progress")
+	if mode == "auto" || mode == "" {
+		mode = "plain"
+		if lockerio.IsTerminal(int(os.Stdout.Fd())) {
+			mode = "tty"
+		}
+	}
+	switch mode {
+	case "plain":
+		return &plainProgress{out: os.Stdout, last: make(map[string]string)}, nil
+	case "tty":
+		return &ttyProgress{out: os.Stdout, lines: make(map[string]int)}, nil
+	case "json":
+		return &jsonProgress{encoder: json.NewEncoder(os.Stdout)}, nil
+	default:
+		return nil, errors.Errorf("invalid progress mode %q, expected auto, tty, plain or json", mode)
+	}
+}
+
+// plainProgress prints a line whenever the status of a layer changes, byte progress is not printed
+type plainProgress struct {
+	mu   sync.Mutex
+	out  io.Writer
+	last map[string]string // last status printed per layer
+}
+
+func (p *plainProgress) update(e progressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e.ID == "" {
+		fmt.Fprintln(p.out, e.Status)
+		return
+	}
+	if p.last[e.ID] == e.Status {
+		return
+	}
+	p.last[e.ID] = e.Status
+	fmt.Fprintf(p.out, "%s: %s\n", e.ID, e.Status)
+}
+
+// ttyProgress keeps a line per layer, and redraws it in place with a progress bar
+type ttyProgress struct {
+	mu    sync.Mutex
+	out   io.Writer
+	lines map[string]int // line index per layer
+	count int            // number of lines printed
+}
+
+func (p *ttyProgress) update(e progressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e.ID == "" {
+		fmt.Fprintln(p.out, e.Status)
+		p.count++
+		return
+	}
+	line, ok := p.lines[e.ID]
+	if !ok {
+		line = p.count
+		p.lines[e.ID] = line
+		p.count++
+		fmt.Fprintln(p.out)
+	}
+	text := fmt.Sprintf("%s: %s", e.ID, e.Status)
+	if e.Total > 0 {
+		text += " " + progressBar(e.Current, e.Total)
+	}
+	// move up to the line of the layer, redraw it, and move back down
+	up := p.count - line
+	fmt.Fprintf(p.out, "\033[%dA\r\033[2K%s\033[%dB\r", up, text, up)
+}
+
+// progressBar returns a textual progress bar, e.g. [=====>    ] 1.2M/3.4M
+func progressBar(current, total int64) string {
+	if current > total {
+		current = total
+	}
+	filled := int(int64(progressBarWidth) * current / total)
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	return fmt.Sprintf("[%s] %s/%s", bar, bytefmt.ByteSize(uint64(current)), bytefmt.ByteSize(uint64(total)))
+}
+
+// jsonProgress prints every event as a JSON object on its own line
+type jsonProgress struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func (p *jsonProgress) update(e progressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.encoder.Encode(e)
+}
+
+// progressReader reports the number of bytes read through it, at most once per progressInterval
+type progressReader struct {
+	r        io.Reader
+	reporter progressReporter
+	event    progressEvent
+	reported time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.event.Current += int64(n)
+	if now := time.Now(); err != nil || now.Sub(p.reported) >= progressInterval {
+		p.reported = now
+		p.reporter.update(p.event)
+	}
+	return n, err
+}
@@ -0,0 +1,435 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gitlab.com/amit-yuval/locker/internal/mount"
+	"gitlab.com/amit-yuval/locker/internal/utils"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// pruner collects garbage of the image store, and reports what it removes
+type pruner struct {
+	dryRun    bool
+	inUse     map[string]bool // references of images run by live containers
+	report    string
+	reclaimed int64
+}
+
+// PruneImages removes directories of containers that are no longer running, stale mounts of such containers,
+// outdated images they used, and layers, blobs, build cache entries and temporary files no image uses, returns a report of what was removed
+// if maxSize is positive, the least recently used images not run by a container are removed until
+// the layers and blobs of the remaining images fit in maxSize bytes
+// on a dry run nothing is removed, the report lists what would be
+func PruneImages(dryRun bool, maxSize int64) (string, error) {
+	// pulls in progress create layers and blobs before they are recorded in the store
+	unlockPulls, err := lockPulls(true)
+	if err != nil {
+		return "", err
+	}
+	defer unlockPulls()
+
+	p := &pruner{dryRun: dryRun, inUse: make(map[string]bool)}
+	err = updateStore(func(s *imageStore) error {
+		if err := p.pruneContainers(s); err != nil {
+			return err
+		}
+		// evictions of a dry run apply to a copy of the store, so the report includes the layers they would free
+		kept := &imageStore{Version: s.Version, Images: make(map[string]*imageRecord)}
+		for name, r := range s.Images {
+			kept.Images[name] = r
+		}
+		p.pruneOutdated(kept)
+		if maxSize > 0 {
+			if err := p.evictImages(kept, maxSize); err != nil {
+				return err
+			}
+		}
+		if err := p.pruneLayers(kept); err != nil {
+			return err
+		}
+		if err := p.pruneBlobs(kept); err != nil {
+			return err
+		}
+		p.pruneBuildCache(s, kept)
+		if !p.dryRun {
+			s.Images = kept.Images
+		}
+		return nil
+	})
+	if err != nil {
+		return p.report, err
+	}
+	if p.dryRun {
+		p.report += fmt.Sprintf("Total reclaimable space: %s\n", bytefmt.ByteSize(uint64(p.reclaimed)))
+	} else {
+		p.report += fmt.Sprintf("Total reclaimed space: %s\n", bytefmt.ByteSize(uint64(p.reclaimed)))
+	}
+	return p.report, nil
+}
+
+// remove calls remove, unless on a dry run, and reports the removal of what, freeing size bytes
+func (p *pruner) remove(what string, size int64, remove func() error) error {
+	if !p.dryRun {
+		if err := remove(); err != nil {
+			return err
+		}
+		p.report += fmt.Sprintf("Deleted %s (%s)\n", what, bytefmt.ByteSize(uint64(size)))
+	} else {
+		p.report += fmt.Sprintf("Would delete %s (%s)\n", what, bytefmt.ByteSize(uint64(size)))
+	}
+	p.reclaimed += size
+	return nil
+}
+
+// pruneContainers unmounts and deletes directories of containers that are no longer running,
+// and records the images of running containers as in use
+func (p *pruner) pruneContainers(s *imageStore) error {
+	dirs, err := containerDirs()
+	if err != nil {
+		return err
+	}
+	// containers of older versions of locker are in the directory of their image
+	legacyImages := make(map[string]string)
+	for name := range s.Images {
+		if ref, err := ParseReference(name); err == nil {
+			legacyImages[ref.path()] = name
+		}
+	}
+	roots := processRoots()
+	var orphans []string
+	running := make(map[string]bool)
+	for _, dir := range dirs {
+		if !containerRunning(dir, roots) {
+			orphans = append(orphans, dir)
+		} else if r := readContainerRecord(dir); r != nil {
+			if r.Image != "" {
+				p.inUse[r.Image] = true
+			}
+			running[r.ImageDigest] = true
+		} else if name, ok := legacyImages[filepath.Dir(dir)]; ok {
+			p.inUse[name] = true
+		}
+	}
+	// the tag of the image of a container may have moved, its outdated image is kept by digest
+	for name, r := range s.Images {
+		if r.Outdated && running[r.ManifestDigest] {
+			p.inUse[name] = true
+		}
+	}
+
+	mountPoints, err := mount.MountPoints(imagesDir)
+	if err != nil {
+		return err
+	}
+	// submounts are unmounted before the mounts containing them
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		point := mountPoints[i]
+		if !strings.Contains(point, "/"+containerDirPrefix) || mountedByRunning(point, dirs, orphans) {
+			continue
+		}
+		if p.dryRun {
+			p.report += fmt.Sprintf("Would unmount %s\n", point)
+			continue
+		}
+		if err := unix.Unmount(point, unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+			return errors.Wrapf(err, "couldn't unmount %s", point)
+		}
+		p.report += fmt.Sprintf("Unmounted %s\n", point)
+	}
+
+	for _, dir := range orphans {
+		size, err := containerSize(dir)
+		if err != nil {
+			return err
+		}
+		err = p.remove("container "+strings.TrimPrefix(dir, imagesDir), size, func() error {
+			// never delete through a mount, the directory would be removed from the image layers or volumes
+			if mounted, err := mount.MountPoints(dir); err != nil {
+				return err
+			} else if len(mounted) > 0 {
+				return errors.Errorf("container %s is still mounted at %s", dir, mounted[0])
+			}
+			if err := os.RemoveAll(dir); err != nil {
+				return errors.Wrapf(err, "couldn't remove container %s", dir)
+			}
+			// image directories of older versions of locker are removed with their last container
+			for parent := filepath.Dir(dir); parent != filepath.Clean(imagesDir) && parent != filepath.Clean(containersDir); parent = filepath.Dir(parent) {
+				if err := os.Remove(parent); err != nil {
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountedByRunning returns true if mount point belongs to a container directory which isn't orphaned,
+// mount points of deleted container directories belong to none
+func mountedByRunning(point string, dirs, orphans []string) bool {
+	for _, dir := range dirs {
+		if isSubpath(point, dir) {
+			for _, orphan := range orphans {
+				if orphan == dir {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// containerDirs returns the container directories, in the containers directory and, for containers
+// of older versions of locker, in image directories
+func containerDirs() ([]string, error) {
+	var dirs []string
+	err := filepath.Walk(imagesDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path == filepath.Clean(layersDir) || path == filepath.Clean(blobsDir) {
+			return filepath.SkipDir
+		}
+		if strings.HasPrefix(info.Name(), containerDirPrefix) {
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't list container directories")
+	}
+	return dirs, nil
+}
+
+// containerSize returns the disk usage of a container directory, without its mounted image
+func containerSize(dir string) (int64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't read container %s", dir)
+	}
+	var size int64
+	for _, entry := range entries {
+		if entry.Name() == Merged {
+			continue
+		}
+		entrySize, err := utils.DirSize(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return 0, errors.Wrap(err, "couldn't get disk usage of directory")
+		}
+		size += entrySize
+	}
+	return size, nil
+}
+
+// pruneOutdated removes outdated images of s no running container uses
+func (p *pruner) pruneOutdated(s *imageStore) {
+	for _, name := range s.names() {
+		if !s.Images[name].Outdated || p.inUse[name] {
+			continue
+		}
+		delete(s.Images, name)
+		if p.dryRun {
+			p.report += fmt.Sprintf("Would delete outdated image %s\n", name)
+		} else {
+			p.report += fmt.Sprintf("Deleted outdated image %s\n", name)
+		}
+	}
+}
+
+// evictImages removes the least recently used images of s that no container runs,
+// until the layers and blobs of the images of s fit in maxSize bytes
+func (p *pruner) evictImages(s *imageStore, maxSize int64) error {
+	// disk usage of each layer directory and blob, and the number of images using it
+	sizes := make(map[string]int64)
+	counts := make(map[string]int)
+	paths := make(map[string][]string)
+	var total int64
+	for name, r := range s.Images {
+		imagePaths, err := r.layerDirs()
+		if err != nil {
+			return err
+		}
+		digests, err := r.blobs()
+		if err != nil {
+			return err
+		}
+		for _, digest := range digests {
+			path, err := blobPath(digest)
+			if err != nil {
+				return err
+			}
+			imagePaths = append(imagePaths, path)
+		}
+		for _, path := range imagePaths {
+			if _, ok := sizes[path]; !ok {
+				size, err := utils.DirSize(path)
+				if err != nil && !os.IsNotExist(err) {
+					return errors.Wrap(err, "couldn't get disk usage of directory")
+				}
+				sizes[path] = size
+			}
+			if counts[path] == 0 {
+				total += sizes[path]
+			}
+			counts[path]++
+		}
+		paths[name] = imagePaths
+	}
+
+	var candidates []string
+	for name := range s.Images {
+		if !p.inUse[name] {
+			candidates = append(candidates, name)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := s.Images[candidates[i]].lastUsed(), s.Images[candidates[j]].lastUsed()
+		if a.Equal(b) {
+			return candidates[i] < candidates[j]
+		}
+		return a.Before(b)
+	})
+	for _, name := range candidates {
+		if total <= maxSize {
+			break
+		}
+		for _, path := range paths[name] {
+			if counts[path]--; counts[path] == 0 {
+				total -= sizes[path]
+			}
+		}
+		delete(s.Images, name)
+		if p.dryRun {
+			p.report += fmt.Sprintf("Would evict image %s\n", name)
+		} else {
+			p.report += fmt.Sprintf("Evicted image %s\n", name)
+		}
+	}
+	if total > maxSize {
+		p.report += fmt.Sprintf("Images run by containers use %s, more than the size budget of %s\n",
+			bytefmt.ByteSize(uint64(total)), bytefmt.ByteSize(uint64(maxSize)))
+	}
+	return nil
+}
+
+// pruneLayers removes layers no image of s uses, and layers left unpacking by interrupted pulls
+func (p *pruner) pruneLayers(s *imageStore) error {
+	counts := s.layerRefCounts()
+	entries, err := ioutil.ReadDir(layersDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "couldn't read layers directory")
+	}
+	for _, entry := range entries {
+		layerDir := filepath.Join(layersDir, entry.Name())
+		if counts[layerDir] > 0 {
+			continue
+		}
+		what := "layer " + shortDigest("sha256:"+entry.Name())
+		if strings.HasPrefix(entry.Name(), ".") {
+			what = "temporary layer " + entry.Name()
+		}
+		size, err := utils.DirSize(layerDir)
+		if err != nil {
+			return errors.Wrap(err, "couldn't get disk usage of directory")
+		}
+		err = p.remove(what, size, func() error {
+			if err := os.RemoveAll(layerDir); err != nil {
+				return errors.Wrapf(err, "couldn't remove layer %s", entry.Name())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneBuildCache removes build cache entries of s whose layer no image of kept uses, as their layers were pruned
+func (p *pruner) pruneBuildCache(s, kept *imageStore) {
+	counts := kept.layerRefCounts()
+	removed := 0
+	for key, entry := range s.BuildCache {
+		if layerDir, err := layerPath(entry.DiffID); err == nil && counts[layerDir] > 0 {
+			continue
+		}
+		if !p.dryRun {
+			delete(s.BuildCache, key)
+		}
+		removed++
+	}
+	if removed > 0 {
+		if p.dryRun {
+			p.report += fmt.Sprintf("Would delete %d build cache entries\n", removed)
+		} else {
+			p.report += fmt.Sprintf("Deleted %d build cache entries\n", removed)
+		}
+	}
+}
+
+// pruneBlobs removes blobs no image of s references, and temporary files left by interrupted pulls and loads
+func (p *pruner) pruneBlobs(s *imageStore) error {
+	used, err := s.usedBlobs()
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(blobsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "couldn't read blobs directory")
+	}
+	var files []string
+	for _, entry := range entries {
+		if !used[entry.Name()] {
+			files = append(files, filepath.Join(blobsDir, entry.Name()))
+		}
+	}
+	// store files being written, archives being loaded, and directories of builds
+	for _, pattern := range []string{".imagedb-*", ".load-*", ".build-*"} {
+		tmpFiles, _ := filepath.Glob(filepath.Join(imagesDir, pattern))
+		files = append(files, tmpFiles...)
+	}
+
+	for _, file := range files {
+		size, err := utils.DirSize(file)
+		if err != nil {
+			return errors.Wrap(err, "couldn't get disk usage of directory")
+		}
+		what := "blob " + shortDigest("sha256:"+filepath.Base(file))
+		if strings.HasPrefix(filepath.Base(file), ".") {
+			what = "temporary file " + strings.TrimPrefix(file, imagesDir)
+		}
+		file := file
+		err = p.remove(what, size, func() error {
+			if err := os.RemoveAll(file); err != nil {
+				return errors.Wrapf(err, "couldn't remove %s", file)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,420 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// pull policies of run and build, for the images they use
+const (
+	PullMissing = "missing" // pull images that aren't stored
+	PullAlways  = "always"  // pull images whose manifest in the registry changed since they were pulled
+	PullNever   = "never"   // use stored images only
+)
+
+// layerDownload is a layer blob being downloaded, done is closed once the download ends
+type layerDownload struct {
+	done chan struct{}
+	blob string
+	err  error
+}
+
+// PullImage pulls requested image ([REGISTRY/]NAME[:TAG][@DIGEST]) from its registry
+// layers already in the layer store are not downloaded again, every downloaded blob is verified
+// against its digest and size, on failure everything created by the pull is removed
+// layers are downloaded concurrently, and extracted in manifest order
+func PullImage(imageName string) error {
+	ref, err := ParseReference(imageName)
+	if err != nil {
+		return err
+	}
+	store, err := readStore()
+	if err != nil {
+		return err
+	}
+	if _, ok := store.get(ref); ok {
+		return fmt.Errorf("Image %s exists", ref)
+	}
+	_, err = pullImage(ref, "")
+	return err
+}
+
+// UpdateImage pulls image imageName again if the manifest its reference resolves to in the registry changed,
+// only layers missing from the layer store are downloaded, an image that isn't stored is pulled
+// returns true if an image was pulled
+func UpdateImage(imageName string) (bool, error) {
+	ref, err := ParseReference(imageName)
+	if err != nil {
+		return false, err
+	}
+	store, err := readStore()
+	if err != nil {
+		return false, err
+	}
+	record, ok := store.get(ref)
+	if !ok {
+		return pullImage(ref, "")
+	}
+	if ref.Digest != "" {
+		// content addressed images never change
+		return false, nil
+	}
+	return pullImage(ref, record.Digest)
+}
+
+// CheckImages compares the digest each tagged image was pulled by with the digest its tag resolves to in its registry,
+// without downloading layers, and writes whether it is up to date or outdated to output
+// if update, outdated images are pulled, only their changed layers are downloaded, containers of the outdated images
+// keep running on their layers, images built, imported, committed, loaded or tagged locally are skipped,
+// their registries don't have them by their references
+func CheckImages(update bool, output io.Writer) error {
+	if err := checkOnline("registries"); err != nil {
+		return err
+	}
+	store, err := readStore()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, name := range store.names() {
+		record := store.Images[name]
+		if record.Tag == "" || record.Local {
+			continue
+		}
+		ref := &Reference{Registry: record.Registry, Repository: record.Repository, Tag: record.Tag}
+		remote, err := remoteDigest(ref, output)
+		if err != nil {
+			fmt.Fprintf(output, "%s: %v\n", ref, err)
+			failed++
+			continue
+		}
+		if remote == record.Digest {
+			fmt.Fprintf(output, "%s: up to date\n", ref)
+			continue
+		}
+		fmt.Fprintf(output, "%s: outdated, %s in the registry, pulled %s\n", ref, shortDigest(remote), orNone(shortDigest(record.Digest)))
+		if !update {
+			continue
+		}
+		if _, err := pullImage(ref, record.Digest); err != nil {
+			fmt.Fprintf(output, "%s: %v\n", ref, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("couldn't check or update %d images", failed)
+	}
+	return nil
+}
+
+// remoteDigest returns the digest the tag of ref resolves to in its registry, of a manifest or manifest list,
+// failures of mirrors of the registry are reported to output
+func remoteDigest(ref *Reference, output io.Writer) (string, error) {
+	client, err := newPullClient(ref, func(msg string) { fmt.Fprintf(output, "%s: %s\n", ref, msg) })
+	if err != nil {
+		return "", err
+	}
+	data, _, err := client.fetchManifest(context.Background(), ref.manifestReference())
+	if err != nil {
+		return "", err
+	}
+	return digestBytes(data), nil
+}
+
+// ensureImage makes image ref available in the store according to pull policy, output receives a note on missing images
+func ensureImage(ref *Reference, policy string, output io.Writer) error {
+	store, err := readStore()
+	if err != nil {
+		return err
+	}
+	_, ok := store.get(ref)
+	switch policy {
+	case PullMissing:
+		if ok {
+			return nil
+		}
+		fmt.Fprintf(output, "Unable to find image %s locally\n", ref)
+		_, err = pullImage(ref, "")
+	case PullAlways:
+		if ok && ref.Digest != "" {
+			// content addressed images never change
+			return nil
+		}
+		_, err = UpdateImage(ref.String())
+	case PullNever:
+		if !ok {
+			return &ImageMissingError{fmt.Sprintf("image %s not found locally, and pull policy is %s", ref, policy)}
+		}
+	default:
+		return errors.Errorf("invalid pull policy %q, expected %s, %s or %s", policy, PullMissing, PullAlways, PullNever)
+	}
+	return err
+}
+
+// pullImage pulls ref, replacing the image stored by ref, unless the digest ref resolves to is current
+// returns true if an image was pulled
+func pullImage(ref *Reference, current string) (pulled bool, err error) {
+	reporter, err := newProgressReporter()
+	if err != nil {
+		return false, err
+	}
+	maxDownloads := viper.GetInt("max-concurrent-downloads")
+	if maxDownloads < 1 {
+		return false, errors.New("max-concurrent-downloads must be at least 1")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wantPlatform, explicitPlatform, err := requestedPlatform()
+	if err != nil {
+		return false, err
+	}
+	client, err := newPullClient(ref, func(msg string) { reporter.update(progressEvent{Status: msg}) })
+	if err != nil {
+		return false, err
+	}
+	manifestData, refDigest, err := client.resolveManifest(ctx, ref, wantPlatform)
+	if err != nil {
+		return false, err
+	}
+	var m manifest
+	if err := json.Unmarshal(manifestData, &m); err != nil {
+		return false, errors.Wrap(err, "couldn't parse manifest")
+	}
+	if err := m.validate(); err != nil {
+		return false, errors.Wrapf(err, "couldn't pull %s", ref)
+	}
+	if refDigest == current {
+		reporter.update(progressEvent{Status: fmt.Sprintf("Image is up to date for %s", ref)})
+		return false, nil
+	}
+	reporter.update(progressEvent{Status: fmt.Sprintf("Pulling from %s", ref.FamiliarName())})
+
+	confResp, err := client.get(ctx, "blobs/"+m.Config.Digest, nil)
+	if err != nil {
+		return false, err
+	}
+	confData, err := ioutil.ReadAll(newVerifier(confResp.Body, m.Config.Digest, m.Config.Size))
+	confResp.Body.Close()
+	if err != nil {
+		return false, errors.Wrap(err, "error receiving config")
+	}
+	if err := verifyBytes(confData, m.Config.Digest, m.Config.Size); err != nil {
+		return false, errors.Wrap(err, "image config is corrupted")
+	}
+	var imageConfig imageConfigFile
+	if err := json.Unmarshal(confData, &imageConfig); err != nil {
+		return false, errors.Wrap(err, "couldn't parse image config")
+	}
+	diffIDs := imageConfig.RootFS.DiffIDs
+	if len(diffIDs) != len(m.Layers) {
+		return false, errors.Errorf("image config of %s doesn't match its manifest", ref)
+	}
+	imagePlatform := imageConfig.platform.normalize()
+	if explicitPlatform && !wantPlatform.matches(imagePlatform) {
+		return false, errors.Errorf("image %s is built for platform %s, requested %s", ref, imagePlatform, wantPlatform)
+	}
+
+	unlockPulls, err := lockPulls(false)
+	if err != nil {
+		return false, err
+	}
+	defer unlockPulls()
+
+	// paths created by this pull, removed if the pull fails
+	var (
+		created   []string
+		createdMu sync.Mutex
+		wg        sync.WaitGroup
+	)
+	defer func() {
+		if err != nil {
+			removeCreated(created)
+		}
+	}()
+	// downloads must end before their blobs are rolled back
+	defer wg.Wait()
+	defer cancel()
+
+	manifestDesc := descriptor{Digest: digestBytes(manifestData), Size: int64(len(manifestData))}
+	if err := createBlob(manifestDesc, manifestData, &created); err != nil {
+		return false, err
+	}
+	if err := createBlob(m.Config, confData, &created); err != nil {
+		return false, err
+	}
+
+	downloads := make([]*layerDownload, len(m.Layers))
+	started := make(map[string]*layerDownload)
+	semaphore := make(chan struct{}, maxDownloads)
+	for i, layer := range m.Layers {
+		layerDir, err := layerPath(diffIDs[i])
+		if err != nil {
+			return false, err
+		}
+		id := layerID(diffIDs[i])
+		if _, err := os.Stat(layerDir); err == nil {
+			reporter.update(progressEvent{ID: id, Status: "Already exists"})
+			continue
+		}
+		if d, ok := started[diffIDs[i]]; ok {
+			downloads[i] = d
+			continue
+		}
+
+		d := &layerDownload{done: make(chan struct{})}
+		downloads[i], started[diffIDs[i]] = d, d
+		reporter.update(progressEvent{ID: id, Status: "Waiting"})
+		wg.Add(1)
+		go func(layer descriptor) {
+			defer wg.Done()
+			defer close(d.done)
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				d.err = ctx.Err()
+				return
+			}
+			d.blob, d.err = client.downloadBlob(ctx, layer, id, reporter)
+			if d.err != nil {
+				cancel()
+				return
+			}
+			reporter.update(progressEvent{ID: id, Status: "Download complete"})
+			createdMu.Lock()
+			created = append(created, d.blob)
+			createdMu.Unlock()
+		}(layer)
+	}
+
+	var layerList []string
+	for i, d := range downloads {
+		layerDir, _ := layerPath(diffIDs[i])
+		layerList = append(layerList, layerDir)
+		if d == nil {
+			continue
+		}
+		<-d.done
+		if d.err != nil {
+			return false, d.err
+		}
+		if _, err := os.Stat(layerDir); err == nil {
+			// layer appears twice in the image, and was already extracted
+			continue
+		}
+		id := layerID(diffIDs[i])
+		reporter.update(progressEvent{ID: id, Status: "Extracting"})
+		if _, err := unpackLayer(d.blob, m.Layers[i].MediaType, diffIDs[i]); err != nil {
+			return false, err
+		}
+		createdMu.Lock()
+		created = append(created, layerDir)
+		createdMu.Unlock()
+		reporter.update(progressEvent{ID: id, Status: "Pull complete"})
+	}
+
+	if err := recordImage(ref, refDigest, manifestDesc.Digest, &m, &imageConfig, layerList, false); err != nil {
+		return false, err
+	}
+	reporter.update(progressEvent{Status: fmt.Sprintf("Digest: %s", refDigest)})
+	if current != "" {
+		reporter.update(progressEvent{Status: fmt.Sprintf("Downloaded newer image for %s", ref)})
+	} else {
+		reporter.update(progressEvent{Status: fmt.Sprintf("Downloaded image %s", ref)})
+	}
+
+	return true, nil
+}
+
+// fetchManifest requests manifest by tag or digest, returns its content and media type
+// the content is verified if requested by digest
+func (c *registryClient) fetchManifest(ctx context.Context, reference string) ([]byte, string, error) {
+	resp, err := c.get(ctx, "manifests/"+reference, map[string]string{
+		"Accept": strings.Join([]string{mediaTypeDockerManifest, mediaTypeDockerManifestList, mediaTypeOCIManifest, mediaTypeOCIIndex}, ", "),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error receiving manifest")
+	}
+	if digestRegexp.MatchString(reference) {
+		if err := verifyBytes(data, reference, -1); err != nil {
+			return nil, "", errors.Wrap(err, "manifest is corrupted")
+		}
+	}
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	if mediaType == "" || mediaType == "application/json" {
+		// fall back to the media type declared in the manifest itself
+		var declared struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(data, &declared)
+		mediaType = declared.MediaType
+	}
+	return data, mediaType, nil
+}
+
+// resolveManifest returns the image manifest of ref, selects the manifest of requested platform
+// if ref is a manifest list, returns the digest ref resolves to (of the list, if ref is a list) as well
+func (c *registryClient) resolveManifest(ctx context.Context, ref *Reference, p platform) ([]byte, string, error) {
+	data, mediaType, err := c.fetchManifest(ctx, ref.manifestReference())
+	if err != nil {
+		return nil, "", err
+	}
+	refDigest := digestBytes(data)
+	if !isManifestList(mediaType) {
+		return data, refDigest, nil
+	}
+	var list manifestList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, "", errors.Wrap(err, "couldn't parse manifest list")
+	}
+	desc, err := list.selectManifest(p)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "couldn't pull %s", ref)
+	}
+	data, mediaType, err = c.fetchManifest(ctx, desc.Digest)
+	if err != nil {
+		return nil, "", err
+	}
+	if isManifestList(mediaType) {
+		return nil, "", errors.Errorf("manifest list of %s references another manifest list", ref)
+	}
+	return data, refDigest, nil
+}
+
+// layerID returns the short id of a layer used in progress output
+func layerID(diffID string) string {
+	return diffID[len("sha256:"):][:idPrintLen]
+}
+
+// createBlob stores data in the blob store, appends the blob to created if it didn't exist before
+func createBlob(desc descriptor, data []byte, created *[]string) error {
+	path, err := blobPath(desc.Digest)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if _, err := writeBlob(desc, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	*created = append(*created, path)
+	return nil
+}
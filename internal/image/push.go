@@ -0,0 +1,266 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// pushChunkSize is the size of the chunks of a chunked blob upload, smaller blobs are uploaded in a single request
+var pushChunkSize int64 = 16 * 1024 * 1024
+
+// PushImage pushes local image imageName to the registry of target ([REGISTRY/]NAME[:TAG]), target defaults to imageName
+// blobs the registry already has are skipped, blobs of the repository the image was pulled from are mounted
+// if it is on the same registry, other blobs are uploaded, in chunks if they are large, the manifest comes last
+// layer blobs missing from the store are pushed from another image with the layer, or fetched from the source repository
+func PushImage(imageName, target string) error {
+	ref, err := ParseReference(imageName)
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		target = imageName
+	}
+	targetRef, err := ParseReference(target)
+	if err != nil {
+		return err
+	}
+	if targetRef.Digest != "" {
+		return errors.Errorf("can't push to %s by digest, images are pushed by tag", targetRef)
+	}
+	if targetRef.Tag == "" {
+		targetRef.Tag = defaultTag
+	}
+	store, err := readStore()
+	if err != nil {
+		return err
+	}
+	record, ok := store.get(ref)
+	if !ok {
+		return errors.Errorf("image %s not found", ref)
+	}
+	if record.ManifestDigest == "" {
+		return errors.Errorf("image %s has no stored manifest, pull it again", ref)
+	}
+	reporter, err := newProgressReporter()
+	if err != nil {
+		return err
+	}
+	// blobs are kept from garbage collection while they are fetched and pushed
+	unlockPulls, err := lockPulls(false)
+	if err != nil {
+		return err
+	}
+	defer unlockPulls()
+	ctx := context.Background()
+	m, err := readManifestBlob(record.ManifestDigest)
+	if err != nil {
+		return err
+	}
+	sources, err := layerSources(store)
+	if err != nil {
+		return err
+	}
+	if err := fetchMissingLayers(ctx, ref, record, m, sources, reporter); err != nil {
+		return err
+	}
+	// the manifest is pushed as stored, so the image keeps its digest, unless a layer is pushed with the blob of another image
+	img, err := savedLayers(ref, record, sources)
+	if err != nil {
+		return err
+	}
+	m, manifestData := img.m, img.manifestData
+
+	mountFrom := ""
+	if record.Registry == targetRef.Registry && record.Repository != targetRef.Repository {
+		mountFrom = record.Repository
+	}
+	client, err := newMountingClient(targetRef, "pull,push", mountFrom)
+	if err != nil {
+		return err
+	}
+	reporter.update(progressEvent{Status: fmt.Sprintf("The push refers to repository [%s]", targetRef.FamiliarName())})
+	for _, desc := range append(m.Layers, m.Config) {
+		if err := client.pushBlob(ctx, desc, reporter); err != nil {
+			return err
+		}
+	}
+
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = mediaTypeDockerManifest
+	}
+	resp, err := client.send(ctx, "PUT", client.repositoryURL("manifests/"+targetRef.Tag), bytes.NewReader(manifestData),
+		int64(len(manifestData)), map[string]string{"Content-Type": mediaType})
+	if err != nil {
+		return errors.Wrap(err, "error pushing manifest")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return errors.Errorf("error pushing manifest of %s: %s", targetRef, resp.Status)
+	}
+	reporter.update(progressEvent{Status: fmt.Sprintf("%s: digest: %s size: %d", targetRef.Tag, digestBytes(manifestData), len(manifestData))})
+	return nil
+}
+
+// fetchMissingLayers downloads the layer blobs of pulled image record that neither it nor another image with the layer has,
+// from the repository it was pulled from
+// pulls don't download the blobs of layers already unpacked, e.g. by a load, build or import of another image
+func fetchMissingLayers(ctx context.Context, ref *Reference, record *imageRecord, m *manifest, sources map[string]descriptor, reporter progressReporter) error {
+	var client *registryClient
+	for i, layer := range m.Layers {
+		blob, err := blobPath(layer.Digest)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(blob); err == nil || i >= len(record.DiffIDs) {
+			continue
+		}
+		if _, ok := sources[record.DiffIDs[i]]; ok || record.Local {
+			continue
+		}
+		if client == nil {
+			source := &Reference{Registry: record.Registry, Repository: record.Repository}
+			warn := func(msg string) { reporter.update(progressEvent{Status: msg}) }
+			if client, err = newPullClient(source, warn); err != nil {
+				return errors.Wrapf(err, "couldn't fetch missing layers of %s from %s", ref, source.FamiliarName())
+			}
+		}
+		id := layerID(record.DiffIDs[i])
+		if _, err := client.downloadBlob(ctx, layer, id, reporter); err != nil {
+			return errors.Wrapf(err, "couldn't fetch missing layer %s of %s", record.DiffIDs[i], ref)
+		}
+		sources[record.DiffIDs[i]] = layer
+		reporter.update(progressEvent{ID: id, Status: "Fetched missing blob"})
+	}
+	return nil
+}
+
+// pushBlob uploads blob desc from the blob store to the repository, unless the registry has it,
+// or it can be mounted from the repository the client mounts from
+func (c *registryClient) pushBlob(ctx context.Context, desc descriptor, reporter progressReporter) error {
+	id := desc.Digest[len("sha256:"):][:idPrintLen]
+	resp, err := c.send(ctx, "HEAD", c.repositoryURL("blobs/"+desc.Digest), nil, 0, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error checking blob %s", desc.Digest)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		reporter.update(progressEvent{ID: id, Status: "Layer already exists"})
+		return nil
+	}
+
+	path, err := blobPath(desc.Digest)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "blob %s of the image is missing from the store", desc.Digest)
+	}
+	defer f.Close()
+
+	reporter.update(progressEvent{ID: id, Status: "Preparing"})
+	uploadURL := c.repositoryURL("blobs/uploads/")
+	if c.mountFrom != "" {
+		uploadURL += "?" + url.Values{"mount": {desc.Digest}, "from": {c.mountFrom}}.Encode()
+	}
+	resp, err = c.send(ctx, "POST", uploadURL, nil, 0, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error starting upload of blob %s", desc.Digest)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		reporter.update(progressEvent{ID: id, Status: "Mounted from " + c.mountFrom})
+		return nil
+	case http.StatusAccepted:
+	default:
+		return errors.Errorf("error starting upload of blob %s: %s", desc.Digest, resp.Status)
+	}
+	location, err := c.location(resp)
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader = &progressReader{
+		r:        f,
+		reporter: reporter,
+		event:    progressEvent{ID: id, Status: "Pushing", Total: desc.Size},
+	}
+	if desc.Size > pushChunkSize {
+		if location, err = c.uploadChunks(ctx, location, body, desc.Size); err != nil {
+			return errors.Wrapf(err, "error uploading blob %s", desc.Digest)
+		}
+		body = nil
+	}
+
+	// the last request completes the upload, with the whole blob if it wasn't uploaded in chunks
+	finishURL, err := url.Parse(location)
+	if err != nil {
+		return errors.Wrapf(err, "invalid upload location %s", location)
+	}
+	query := finishURL.Query()
+	query.Set("digest", desc.Digest)
+	finishURL.RawQuery = query.Encode()
+	resp, err = c.send(ctx, "PUT", finishURL.String(), body, desc.Size, map[string]string{"Content-Type": "application/octet-stream"})
+	if err != nil {
+		return errors.Wrapf(err, "error uploading blob %s", desc.Digest)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return errors.Errorf("error uploading blob %s: %s", desc.Digest, resp.Status)
+	}
+	reporter.update(progressEvent{ID: id, Status: "Pushed"})
+	return nil
+}
+
+// uploadChunks uploads size bytes read from r to the upload at location, in chunks of pushChunkSize,
+// returns the location to complete the upload at
+func (c *registryClient) uploadChunks(ctx context.Context, location string, r io.Reader, size int64) (string, error) {
+	for offset := int64(0); offset < size; {
+		n := size - offset
+		if n > pushChunkSize {
+			n = pushChunkSize
+		}
+		resp, err := c.send(ctx, "PATCH", location, io.LimitReader(r, n), n, map[string]string{
+			"Content-Type":  "application/octet-stream",
+			"Content-Range": fmt.Sprintf("%d-%d", offset, offset+n-1),
+		})
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return "", errors.Errorf("registry responded with %s", resp.Status)
+		}
+		if location, err = c.location(resp); err != nil {
+			return "", err
+		}
+		offset += n
+	}
+	return location, nil
+}
+
+// location returns the absolute url of the Location header of an upload response
+func (c *registryClient) location(resp *http.Response) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", errors.New("registry didn't return an upload location")
+	}
+	base, err := url.Parse(c.endpoint)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid registry endpoint")
+	}
+	u, err := base.Parse(location)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid upload location %s", location)
+	}
+	return u.String(), nil
+}
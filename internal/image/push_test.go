@@ -0,0 +1,348 @@
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// useTempStore points the image store to a temporary directory, returns a function restoring it
+func useTempStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := []string{imagesDir, imagesJsonFile, storeFile, storeLockFile, pullLockFile, containersDir, blobsDir, layersDir}
+	imagesDir = dir + "/"
+	imagesJsonFile = imagesDir + "images.json"
+	storeFile = imagesDir + "imagedb.json"
+	storeLockFile = imagesDir + "imagedb.lock"
+	pullLockFile = imagesDir + "pull.lock"
+	containersDir = imagesDir + "containers/"
+	blobsDir = imagesDir + "blobs/sha256/"
+	layersDir = imagesDir + "layers/sha256/"
+	viper.Set("auth-file", filepath.Join(dir, "auth.json"))
+	return func() {
+		imagesDir, imagesJsonFile, storeFile, storeLockFile = saved[0], saved[1], saved[2], saved[3]
+		pullLockFile, containersDir, blobsDir, layersDir = saved[4], saved[5], saved[6], saved[7]
+		viper.Set("auth-file", nil)
+		os.RemoveAll(dir)
+	}
+}
+
+// storeBlob writes data to the blob store, returns its descriptor
+func storeBlob(t *testing.T, mediaType string, data []byte) descriptor {
+	desc := descriptor{MediaType: mediaType, Digest: digestBytes(data), Size: int64(len(data))}
+	if _, err := writeBlob(desc, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+// storedBlob returns the content of blob digest of the blob store
+func storedBlob(t *testing.T, digest string) []byte {
+	path, err := blobPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// storeImage adds image name with uncompressed layers to the store, only its blobs are stored, layers aren't unpacked
+func storeImage(t *testing.T, name string, layers ...[]byte) (*imageRecord, *manifest) {
+	config := storeBlob(t, mediaTypeDockerConfig, []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers"}}`))
+	m := &manifest{SchemaVersion: 2, MediaType: mediaTypeDockerManifest, Config: config}
+	var diffIDs []string
+	for _, layer := range layers {
+		m.Layers = append(m.Layers, storeBlob(t, mediaTypeDockerLayer, layer))
+		diffIDs = append(diffIDs, digestBytes(layer))
+	}
+	return storeManifest(t, name, m, diffIDs, false), m
+}
+
+// storeManifest adds image name of manifest m, with layers diffIDs, to the store, local if it wasn't pulled
+// the blobs of the manifest aren't stored
+func storeManifest(t *testing.T, name string, m *manifest, diffIDs []string, local bool) *imageRecord {
+	ref, err := ParseReference(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestData, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDesc := storeBlob(t, mediaTypeDockerManifest, manifestData)
+	record := &imageRecord{
+		Registry:       ref.Registry,
+		Repository:     ref.Repository,
+		Tag:            ref.Tag,
+		Digest:         manifestDesc.Digest,
+		ManifestDigest: manifestDesc.Digest,
+		ConfigDigest:   m.Config.Digest,
+		DiffIDs:        diffIDs,
+		Local:          local,
+	}
+	err = updateStore(func(s *imageStore) error {
+		s.Images[ref.String()] = record
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// testRegistry is an in-memory registry accepting pushes and serving blobs, it logs the requests it receives
+type testRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte // blobs by repository and digest
+	uploads   map[string]*bytes.Buffer
+	manifests map[string][]byte // manifests by repository and tag
+	types     map[string]string // content type of manifests
+	requests  []string
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{
+		blobs:     make(map[string][]byte),
+		uploads:   make(map[string]*bytes.Buffer),
+		manifests: make(map[string][]byte),
+		types:     make(map[string]string),
+	}
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.requests = append(reg.requests, r.Method+" "+r.URL.Path)
+	if r.URL.Path == "/v2/" {
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case strings.Contains(path, "/manifests/") && r.Method == http.MethodPut:
+		reg.manifests[path] = body
+		reg.types[path] = r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/blobs/uploads/") && r.Method == http.MethodPost:
+		repo := path[:strings.Index(path, "/blobs/uploads/")]
+		if digest := r.URL.Query().Get("mount"); digest != "" {
+			if data, ok := reg.blobs[r.URL.Query().Get("from")+"@"+digest]; ok {
+				reg.blobs[repo+"@"+digest] = data
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		id := fmt.Sprint(len(reg.uploads))
+		reg.uploads[id] = &bytes.Buffer{}
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id+"?_state=0")
+		w.WriteHeader(http.StatusAccepted)
+	case strings.Contains(path, "/blobs/uploads/"):
+		split := strings.Split(path, "/blobs/uploads/")
+		repo, id := split[0], split[1]
+		upload, ok := reg.uploads[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodPatch {
+			var start, end int
+			fmt.Sscanf(r.Header.Get("Content-Range"), "%d-%d", &start, &end)
+			if start != upload.Len() || end != start+len(body)-1 {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			upload.Write(body)
+			w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s?_state=%d", repo, id, upload.Len()))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		upload.Write(body)
+		digest := r.URL.Query().Get("digest")
+		if digestBytes(upload.Bytes()) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reg.blobs[repo+"@"+digest] = upload.Bytes()
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/blobs/"):
+		split := strings.Split(path, "/blobs/")
+		data, ok := reg.blobs[split[0]+"@"+split[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+		} else if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// count returns the number of requests the registry received with given method and path prefix
+func (reg *testRegistry) count(method, prefix string) int {
+	n := 0
+	for _, r := range reg.requests {
+		if strings.HasPrefix(r, method+" "+prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPushImage(t *testing.T) {
+	defer useTempStore(t)()
+	defer func(size int64) { pushChunkSize = size }(pushChunkSize)
+	pushChunkSize = 4
+
+	reg := newTestRegistry()
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	existing, mounted, small, large := []byte("existing"), []byte("mounted"), []byte("abc"), []byte("0123456789")
+	record, m := storeImage(t, host+"/team/app:v1", existing, mounted, small, large)
+	reg.blobs["team/pushed@"+digestBytes(existing)] = existing
+	reg.blobs["team/app@"+digestBytes(mounted)] = mounted
+
+	if err := PushImage(host+"/team/app:v1", host+"/team/pushed:v2"); err != nil {
+		t.Fatalf("PushImage failed: %v", err)
+	}
+	for _, desc := range append(m.Layers, m.Config) {
+		data := storedBlob(t, desc.Digest)
+		if got := reg.blobs["team/pushed@"+desc.Digest]; !bytes.Equal(got, data) {
+			t.Errorf("blob %s pushed as %q, want %q", desc.Digest, got, data)
+		}
+	}
+	manifestData := storedBlob(t, record.ManifestDigest)
+	if got := reg.manifests["team/pushed/manifests/v2"]; !bytes.Equal(got, manifestData) {
+		t.Errorf("manifest pushed as %s, want the stored manifest %s", got, manifestData)
+	}
+	if got := reg.types["team/pushed/manifests/v2"]; got != mediaTypeDockerManifest {
+		t.Errorf("manifest pushed with content type %q, want %q", got, mediaTypeDockerManifest)
+	}
+
+	tests := []struct {
+		method, path string
+		count        int
+	}{
+		{"HEAD", "/v2/team/pushed/blobs/sha256:", 5},
+		// the mounted blob, the small layer, the config and the large layer
+		{"POST", "/v2/team/pushed/blobs/uploads/", 4},
+		// the large layer and the config, in chunks of 4 bytes
+		{"PATCH", "/v2/team/pushed/blobs/uploads/", 3 + int(m.Config.Size+3)/4},
+		// the small layer, and the end of the chunked uploads
+		{"PUT", "/v2/team/pushed/blobs/uploads/", 3},
+		{"PUT", "/v2/team/pushed/manifests/v2", 1},
+	}
+	for _, test := range tests {
+		if got := reg.count(test.method, test.path); got != test.count {
+			t.Errorf("%d %s %s requests, want %d", got, test.method, test.path, test.count)
+		}
+	}
+	if last := reg.requests[len(reg.requests)-1]; last != "PUT /v2/team/pushed/manifests/v2" {
+		t.Errorf("last request is %s, want the manifest upload", last)
+	}
+}
+
+func TestPushImageErrors(t *testing.T) {
+	defer useTempStore(t)()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	storeImage(t, host+"/app", []byte("layer"))
+
+	tests := []struct {
+		image, target, err string
+	}{
+		{host + "/missing", "", "not found"},
+		{host + "/app", host + "/app@sha256:" + strings.Repeat("a", 64), "by digest"},
+		{host + "/app", "", "error pushing manifest"},
+	}
+	for _, test := range tests {
+		err := PushImage(test.image, test.target)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("PushImage(%q, %q) = %v, want an error containing %q", test.image, test.target, err, test.err)
+		}
+	}
+}
+
+func TestPushMissingLayers(t *testing.T) {
+	defer useTempStore(t)()
+	reg := newTestRegistry()
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// a pull skips the blob of a layer another image unpacked, here a gzip blob of the layer of t/local
+	layer := []byte("shared layer")
+	storeImage(t, "t/local", layer)
+	_, pulledManifest := storeImage(t, host+"/src/other", []byte("other layer"))
+	compressed := descriptor{MediaType: mediaTypeDockerLayerGzip, Digest: digestBytes([]byte("gzip")), Size: 4}
+	substituted := storeManifest(t, host+"/src/app:v1",
+		&manifest{SchemaVersion: 2, MediaType: mediaTypeDockerManifest, Config: pulledManifest.Config, Layers: []descriptor{compressed}},
+		[]string{digestBytes(layer)}, false)
+
+	// no other image has the layer, its blob is fetched from the repository the image was pulled from
+	missing := []byte("missing layer")
+	missingDesc := descriptor{MediaType: mediaTypeDockerLayer, Digest: digestBytes(missing), Size: int64(len(missing))}
+	reg.blobs["src/fetched@"+missingDesc.Digest] = missing
+	missingManifest := &manifest{SchemaVersion: 2, MediaType: mediaTypeDockerManifest, Config: pulledManifest.Config, Layers: []descriptor{missingDesc}}
+	fetched := storeManifest(t, host+"/src/fetched:v1", missingManifest, []string{missingDesc.Digest}, false)
+	storeManifest(t, "t/broken", missingManifest, []string{missingDesc.Digest}, true)
+
+	if err := PushImage(host+"/src/app:v1", host+"/team/substituted:v1"); err != nil {
+		t.Fatalf("pushing an image with a substituted layer failed: %v", err)
+	}
+	if got := reg.blobs["team/substituted@"+digestBytes(layer)]; !bytes.Equal(got, layer) {
+		t.Errorf("substituted layer pushed as %q, want %q", got, layer)
+	}
+	var pushed manifest
+	if err := json.Unmarshal(reg.manifests["team/substituted/manifests/v1"], &pushed); err != nil {
+		t.Fatal(err)
+	}
+	if len(pushed.Layers) != 1 || pushed.Layers[0].Digest != digestBytes(layer) || pushed.Layers[0].MediaType != mediaTypeDockerLayer {
+		t.Errorf("manifest pushed with layers %+v, want the blob of t/local", pushed.Layers)
+	}
+	if digestBytes(reg.manifests["team/substituted/manifests/v1"]) == substituted.ManifestDigest {
+		t.Error("manifest with a substituted layer pushed as stored")
+	}
+
+	if err := PushImage(host+"/src/fetched:v1", host+"/team/fetched:v1"); err != nil {
+		t.Fatalf("pushing an image with a missing layer failed: %v", err)
+	}
+	if got := storedBlob(t, missingDesc.Digest); !bytes.Equal(got, missing) {
+		t.Errorf("fetched blob stored as %q, want %q", got, missing)
+	}
+	if got := reg.manifests["team/fetched/manifests/v1"]; digestBytes(got) != fetched.ManifestDigest {
+		t.Errorf("manifest of an image with a fetched layer pushed as %s, want the stored manifest", got)
+	}
+
+	os.Remove(filepath.Join(blobsDir, strings.TrimPrefix(missingDesc.Digest, "sha256:")))
+	delete(reg.blobs, "src/fetched@"+missingDesc.Digest)
+	if err := PushImage("t/broken", host+"/team/broken:v1"); err == nil || !strings.Contains(err.Error(), "has no blob") {
+		t.Errorf("pushing a local image with a missing layer: got %v, want an error about the missing blob", err)
+	}
+}
@@ -0,0 +1,100 @@
+package image
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	nameRegexp   = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	hostRegexp   = regexp.MustCompile(`^(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?$`)
+	tagRegexp    = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// Reference is a parsed image reference of the form [REGISTRY/]REPOSITORY[:TAG][@DIGEST]
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses given image reference, defaults to the latest tag if no tag or digest is given
+// and to docker hub if no registry is given
+func ParseReference(s string) (*Reference, error) {
+	ref := &Reference{Registry: defaultRegistry}
+	name := s
+	if i := strings.Index(name, "@"); i != -1 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if !digestRegexp.MatchString(ref.Digest) {
+			return nil, errors.Errorf("invalid digest %q in reference %q", ref.Digest, s)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i != -1 && !strings.Contains(name[i:], "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return nil, errors.Errorf("invalid tag %q in reference %q", ref.Tag, s)
+		}
+	}
+	// first component is a registry if it looks like a host name
+	if i := strings.Index(name, "/"); i != -1 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		ref.Registry, name = name[:i], name[i+1:]
+		if !hostRegexp.MatchString(ref.Registry) {
+			return nil, errors.Errorf("invalid registry %q in reference %q", ref.Registry, s)
+		}
+	}
+	if ref.Registry == defaultRegistry && !strings.Contains(name, "/") {
+		name = officialNamespace + name
+	}
+	if !nameRegexp.MatchString(name) {
+		return nil, errors.Errorf("invalid image name %q", s)
+	}
+	ref.Repository = name
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+	return ref, nil
+}
+
+// FamiliarName returns the repository name as displayed to the user,
+// omits docker hub and its official images namespace
+func (r *Reference) FamiliarName() string {
+	if r.Registry != defaultRegistry {
+		return r.Registry + "/" + r.Repository
+	}
+	return strings.TrimPrefix(r.Repository, officialNamespace)
+}
+
+// String returns the reference in its familiar NAME[:TAG][@DIGEST] form
+func (r *Reference) String() string {
+	ret := r.FamiliarName()
+	if r.Tag != "" {
+		ret += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		ret += "@" + r.Digest
+	}
+	return ret
+}
+
+// manifestReference returns the tag or digest to request the manifest by, digest takes precedence
+func (r *Reference) manifestReference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// path returns the directory older versions of locker stored the referenced image in
+// colons are replaced, since they separate directories in overlay mount options
+func (r *Reference) path() string {
+	suffix := r.Tag
+	if r.Digest != "" {
+		suffix += "@" + strings.Replace(r.Digest, ":", "-", 1)
+	}
+	return filepath.Join(imagesDir, strings.Replace(r.FamiliarName(), ":", "+", 1), suffix)
+}
@@ -0,0 +1,76 @@
+package image
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		in   string
+		want Reference
+	}{
+		{"alpine", Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "latest"}},
+		{"alpine:3.12", Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.12"}},
+		{"myorg/tool", Reference{Registry: "docker.io", Repository: "myorg/tool", Tag: "latest"}},
+		{"alpine@" + digest, Reference{Registry: "docker.io", Repository: "library/alpine", Digest: digest}},
+		{"alpine:3.12@" + digest, Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.12", Digest: digest}},
+		{"registry.example.com:5000/team/app", Reference{Registry: "registry.example.com:5000", Repository: "team/app", Tag: "latest"}},
+		{"registry.example.com/app:v1", Reference{Registry: "registry.example.com", Repository: "app", Tag: "v1"}},
+		{"localhost/app", Reference{Registry: "localhost", Repository: "app", Tag: "latest"}},
+		{"localhost:5000/app:v1", Reference{Registry: "localhost:5000", Repository: "app", Tag: "v1"}},
+	}
+	for _, test := range tests {
+		ref, err := ParseReference(test.in)
+		if err != nil {
+			t.Errorf("ParseReference(%q) failed: %v", test.in, err)
+			continue
+		}
+		if *ref != test.want {
+			t.Errorf("ParseReference(%q) = %+v, want %+v", test.in, *ref, test.want)
+		}
+	}
+}
+
+func TestParseReferenceInvalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"Alpine",
+		"alpine:",
+		"alpine:-tag",
+		"alpine@sha256:abc",
+		"alpine@md5:" + strings.Repeat("a", 64),
+		"bad_host.com/app",
+		"app//name",
+		"../app",
+	} {
+		if ref, err := ParseReference(in); err == nil {
+			t.Errorf("ParseReference(%q) = %+v, want an error", in, *ref)
+		}
+	}
+}
+
+func TestReferenceString(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("b", 64)
+	tests := []struct {
+		in, familiar, str string
+	}{
+		{"alpine", "alpine", "alpine:latest"},
+		{"docker.io/library/alpine:3.12", "alpine", "alpine:3.12"},
+		{"myorg/tool@" + digest, "myorg/tool", "myorg/tool@" + digest},
+		{"localhost:5000/app:v1", "localhost:5000/app", "localhost:5000/app:v1"},
+	}
+	for _, test := range tests {
+		ref, err := ParseReference(test.in)
+		if err != nil {
+			t.Fatalf("ParseReference(%q) failed: %v", test.in, err)
+		}
+		if got := ref.FamiliarName(); got != test.familiar {
+			t.Errorf("FamiliarName of %q = %q, want %q", test.in, got, test.familiar)
+		}
+		if got := ref.String(); got != test.str {
+			t.Errorf("String of %q = %q, want %q", test.in, got, test.str)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	archiveManifestFile     = "manifest.json" // image list of a docker archive
+	ociLayoutFile           = "oci-layout"
+	ociIndexFile            = "index.json"
+	ociBlobsDir             = "blobs/sha256"
+	ociLayoutVersion        = "1.0.0"
+	annotationImageName     = "io.containerd.image.name"
+	annotationRefName       = "org.opencontainers.image.ref.name"
+	archiveLayerFile        = "layer.tar"
+	archiveConfigFileSuffix = ".json"
+)
+
+// archiveManifest is an image of a docker archive, as listed in its manifest.json file
+type archiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// ociLayout is the oci-layout file of an OCI image layout
+type ociLayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// savedImage is a local image being saved to an archive
+type savedImage struct {
+	ref          *Reference
+	record       *imageRecord
+	m            *manifest
+	manifestData []byte
+}
+
+// archiveWriter writes the files of an image archive, each once
+type archiveWriter struct {
+	tw      *tar.Writer
+	written map[string]bool
+}
+
+// SaveImages writes local images to w as a tar archive, in the OCI image layout if oci is set,
+// or in the layout of docker save otherwise
+// layers are saved as pulled in an OCI image layout, and uncompressed in a docker archive
+func SaveImages(w io.Writer, imageNames []string, oci bool) error {
+	store, err := readStore()
+	if err != nil {
+		return err
+	}
+	sources, err := layerSources(store)
+	if err != nil {
+		return err
+	}
+	var images []savedImage
+	for _, name := range imageNames {
+		ref, err := ParseReference(name)
+		if err != nil {
+			return err
+		}
+		record, ok := store.get(ref)
+		if !ok {
+			return &ImageMissingError{msg: fmt.Sprintf("image %s not found", ref)}
+		}
+		if record.ManifestDigest == "" {
+			return errors.Errorf("image %s was pulled by an older version of locker without its layer blobs, pull it again to save it", ref)
+		}
+		img, err := savedLayers(ref, record, sources)
+		if err != nil {
+			return err
+		}
+		images = append(images, img)
+	}
+
+	a := &archiveWriter{tw: tar.NewWriter(w), written: make(map[string]bool)}
+	if oci {
+		err = a.writeOCILayout(images)
+	} else {
+		err = a.writeDockerArchive(images)
+	}
+	if err != nil {
+		return err
+	}
+	if err := a.tw.Close(); err != nil {
+		return errors.Wrap(err, "couldn't write archive")
+	}
+	return nil
+}
+
+// layerSources returns a layer blob in the blob store of each layer of the images of s, by diff ID
+func layerSources(s *imageStore) (map[string]descriptor, error) {
+	sources := make(map[string]descriptor)
+	for _, r := range s.Images {
+		if r.ManifestDigest == "" {
+			continue
+		}
+		m, err := readManifestBlob(r.ManifestDigest)
+		if err != nil {
+			return nil, err
+		}
+		for i, layer := range m.Layers {
+			blob, err := blobPath(layer.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := os.Stat(blob); err == nil && i < len(r.DiffIDs) {
+				sources[r.DiffIDs[i]] = layer
+			}
+		}
+	}
+	return sources, nil
+}
+
+// savedLayers returns the image of record to save or push, with the manifest it is saved or pushed by
+// a pull doesn't download layers already unpacked, a layer without its own blob is saved with
+// another blob of the same content, and the image is saved by a manifest listing that blob
+func savedLayers(ref *Reference, record *imageRecord, sources map[string]descriptor) (savedImage, error) {
+	img := savedImage{ref: ref, record: record}
+	blob, err := blobPath(record.ManifestDigest)
+	if err != nil {
+		return img, err
+	}
+	if img.manifestData, err = ioutil.ReadFile(blob); err != nil {
+		return img, errors.Wrapf(err, "couldn't read manifest %s", record.ManifestDigest)
+	}
+	img.m = &manifest{}
+	if err := json.Unmarshal(img.manifestData, img.m); err != nil {
+		return img, errors.Wrapf(err, "couldn't parse manifest %s", record.ManifestDigest)
+	}
+	changed := false
+	for i, layer := range img.m.Layers {
+		blob, err := blobPath(layer.Digest)
+		if err != nil {
+			return img, err
+		}
+		if _, err := os.Stat(blob); err == nil {
+			continue
+		}
+		source, ok := sources[record.DiffIDs[i]]
+		if !ok {
+			return img, errors.Errorf("layer %s of image %s has no blob, nor does any other image with the layer", record.DiffIDs[i], ref)
+		}
+		img.m.Layers[i], changed = source, true
+	}
+	if changed {
+		if img.manifestData, err = json.Marshal(img.m); err != nil {
+			return img, errors.Wrap(err, "couldn't marshal manifest")
+		}
+	}
+	return img, nil
+}
+
+// writeDockerArchive writes images in the layout of docker save: a manifest.json file listing the images,
+// config files named by their digest, and an uncompressed layer.tar file in a directory per layer
+// images saved by several references are listed once, with all of their tags
+func (a *archiveWriter) writeDockerArchive(images []savedImage) error {
+	var entries []*archiveManifest
+	byManifest := make(map[string]*archiveManifest)
+	for _, img := range images {
+		if img.ref.Tag == "" {
+			return errors.Errorf("image %s has no tag, docker archives name images by tag, save it with --oci", img.ref)
+		}
+		tag := (&Reference{Registry: img.ref.Registry, Repository: img.ref.Repository, Tag: img.ref.Tag}).String()
+		if entry, ok := byManifest[img.record.ManifestDigest]; ok {
+			entry.RepoTags = append(entry.RepoTags, tag)
+			continue
+		}
+		configHex, err := digestHex(img.m.Config.Digest)
+		if err != nil {
+			return err
+		}
+		entry := &archiveManifest{Config: configHex + archiveConfigFileSuffix, RepoTags: []string{tag}}
+		if err := a.writeBlobFile(entry.Config, img.m.Config.Digest); err != nil {
+			return err
+		}
+		for i, layer := range img.m.Layers {
+			diffHex, err := digestHex(img.record.DiffIDs[i])
+			if err != nil {
+				return err
+			}
+			name := path.Join(diffHex, archiveLayerFile)
+			if err := a.writeLayerTar(name, layer, img.record.DiffIDs[i]); err != nil {
+				return err
+			}
+			entry.Layers = append(entry.Layers, name)
+		}
+		entries = append(entries, entry)
+		byManifest[img.record.ManifestDigest] = entry
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal archive manifest")
+	}
+	return a.writeFile(archiveManifestFile, int64(len(data)), bytes.NewReader(data))
+}
+
+// writeOCILayout writes images in the OCI image layout: the manifest, config and layer blobs of the images
+// in a content addressable blobs directory, and an index.json file naming the manifest of each reference
+func (a *archiveWriter) writeOCILayout(images []savedImage) error {
+	index := manifestList{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []platformDescriptor{}}
+	for _, img := range images {
+		manifestDesc := descriptor{Digest: digestBytes(img.manifestData), Size: int64(len(img.manifestData))}
+		manifestHex, err := digestHex(manifestDesc.Digest)
+		if err != nil {
+			return err
+		}
+		manifestName := path.Join(ociBlobsDir, manifestHex)
+		if !a.written[manifestName] {
+			if err := a.writeFile(manifestName, manifestDesc.Size, bytes.NewReader(img.manifestData)); err != nil {
+				return err
+			}
+		}
+		digests := []string{img.m.Config.Digest}
+		for _, layer := range img.m.Layers {
+			digests = append(digests, layer.Digest)
+		}
+		for _, digest := range digests {
+			hex, err := digestHex(digest)
+			if err != nil {
+				return err
+			}
+			if err := a.writeBlobFile(path.Join(ociBlobsDir, hex), digest); err != nil {
+				return err
+			}
+		}
+		mediaType := img.m.MediaType
+		if mediaType == "" {
+			mediaType = mediaTypeOCIManifest
+		}
+		desc := platformDescriptor{
+			descriptor:  descriptor{MediaType: mediaType, Digest: manifestDesc.Digest, Size: manifestDesc.Size},
+			Annotations: map[string]string{annotationImageName: img.ref.String()},
+		}
+		if img.ref.Tag != "" {
+			desc.Annotations[annotationRefName] = img.ref.Tag
+		}
+		if p, err := parsePlatform(img.record.Platform); err == nil {
+			desc.Platform = &p
+		}
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	layout, err := json.Marshal(&ociLayout{ImageLayoutVersion: ociLayoutVersion})
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal oci-layout")
+	}
+	if err := a.writeFile(ociLayoutFile, int64(len(layout)), bytes.NewReader(layout)); err != nil {
+		return err
+	}
+	data, err := json.Marshal(&index)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal image index")
+	}
+	return a.writeFile(ociIndexFile, int64(len(data)), bytes.NewReader(data))
+}
+
+// writeBlobFile writes the blob of digest from the blob store to the archive as name
+func (a *archiveWriter) writeBlobFile(name, digest string) error {
+	if a.written[name] {
+		return nil
+	}
+	blob, err := blobPath(digest)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(blob)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open blob %s", digest)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open blob %s", digest)
+	}
+	return a.writeFile(name, info.Size(), f)
+}
+
+// writeLayerTar writes the uncompressed content of layer to the archive as name, verified against diffID
+// the layer is decompressed twice, first to learn its size for the tar header
+func (a *archiveWriter) writeLayerTar(name string, layer descriptor, diffID string) error {
+	if a.written[name] {
+		return nil
+	}
+	size, err := readLayerTar(layer, diffID, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	if err := a.writeHeader(name, size); err != nil {
+		return err
+	}
+	if _, err := readLayerTar(layer, diffID, a.tw); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readLayerTar writes the uncompressed content of layer blob to w, returns its size
+func readLayerTar(layer descriptor, diffID string, w io.Writer) (int64, error) {
+	c, err := layerCompression(layer.MediaType)
+	if err != nil {
+		return 0, err
+	}
+	blob, err := blobPath(layer.Digest)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(blob)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't open blob %s", layer.Digest)
+	}
+	defer f.Close()
+	r, err := decompress(c, f)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't decompress layer %s", diffID)
+	}
+	defer r.Close()
+	v := newVerifier(r, diffID, -1)
+	size, err := io.Copy(w, v)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't write layer %s", diffID)
+	}
+	if err := r.Close(); err != nil {
+		return 0, errors.Wrapf(err, "couldn't decompress layer %s", diffID)
+	}
+	if err := v.verify(); err != nil {
+		return 0, errors.Wrapf(err, "layer %s is corrupted", diffID)
+	}
+	return size, nil
+}
+
+// writeFile writes a file of size bytes read from r to the archive as name
+func (a *archiveWriter) writeFile(name string, size int64, r io.Reader) error {
+	if err := a.writeHeader(name, size); err != nil {
+		return err
+	}
+	if _, err := io.Copy(a.tw, r); err != nil {
+		return errors.Wrapf(err, "couldn't write %s to archive", name)
+	}
+	return nil
+}
+
+// writeHeader writes the header of file name to the archive, preceded by headers of its directories
+func (a *archiveWriter) writeHeader(name string, size int64) error {
+	var dirs []string
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	for _, dir := range dirs {
+		if a.written[dir+"/"] {
+			continue
+		}
+		hdr := &tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755, ModTime: time.Unix(0, 0)}
+		if err := a.tw.WriteHeader(hdr); err != nil {
+			return errors.Wrap(err, "couldn't write archive")
+		}
+		a.written[dir+"/"] = true
+	}
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: strings.TrimPrefix(name, "/"), Size: size, Mode: 0644, ModTime: time.Unix(0, 0)}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "couldn't write archive")
+	}
+	a.written[name] = true
+	return nil
+}
@@ -0,0 +1,172 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// registryPathRegexp matches paths of the registry API locker serves, of the manifests, blobs and tags of a repository
+var registryPathRegexp = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs|tags)/([^/]+)$`)
+
+// registryHandler serves the images of the local store over the registry HTTP API V2, read-only
+// images of docker hub are served by repository (library/alpine), images of other registries by registry and repository
+type registryHandler struct{}
+
+// ServeRegistry serves the images of the local store as a read-only registry on addr (e.g. ":5000"), over plain HTTP,
+// until SIGINT or SIGTERM
+func ServeRegistry(addr string) error {
+	server := &http.Server{Addr: addr, Handler: registryHandler{}}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, unix.SIGINT, unix.SIGTERM)
+	defer signal.Stop(stop)
+	go func() {
+		<-stop
+		server.Close()
+	}()
+
+	fmt.Printf("Serving local images on %s\n", addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return errors.Wrap(err, "couldn't serve registry")
+	}
+	return nil
+}
+
+// registryError writes an error response of the registry API
+func registryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+func (registryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		registryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the registry is read-only")
+		return
+	}
+	if req.URL.Path == "/v2/" || req.URL.Path == "/v2" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	match := registryPathRegexp.FindStringSubmatch(req.URL.Path)
+	if match == nil || (match[2] == "tags" && match[3] != "list") {
+		registryError(w, http.StatusNotFound, "NOT_FOUND", "unknown path")
+		return
+	}
+	store, err := readStore()
+	if err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	records := repositoryRecords(store, match[1])
+	if len(records) == 0 {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository not found")
+		return
+	}
+	switch match[2] {
+	case "manifests":
+		serveManifest(w, req, records, match[3])
+	case "blobs":
+		serveBlob(w, req, records, match[3])
+	case "tags":
+		tags := []string{}
+		for _, r := range records {
+			if r.Tag != "" {
+				tags = append(tags, r.Tag)
+			}
+		}
+		sort.Strings(tags)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": match[1], "tags": tags})
+	}
+}
+
+// repositoryRecords returns the records of the images of store served by repository name
+func repositoryRecords(store *imageStore, name string) []*imageRecord {
+	var records []*imageRecord
+	for _, storeName := range store.names() {
+		r := store.Images[storeName]
+		if r.Registry == defaultRegistry && r.Repository == name || r.Registry+"/"+r.Repository == name {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// serveManifest serves the stored manifest of the image of records tagged reference, or with digest reference
+// images pulled by a manifest list are served by the manifest of their platform, the list isn't stored
+func serveManifest(w http.ResponseWriter, req *http.Request, records []*imageRecord, reference string) {
+	var found *imageRecord
+	for _, r := range records {
+		if r.ManifestDigest != "" && (r.Tag == reference || r.ManifestDigest == reference) {
+			found = r
+			break
+		}
+	}
+	if found == nil {
+		registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+		return
+	}
+	m, err := readManifestBlob(found.ManifestDigest)
+	if err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = mediaTypeDockerManifest
+	}
+	serveBlobFile(w, req, found.ManifestDigest, mediaType)
+}
+
+// serveBlob serves blob digest, if it is part of an image of records
+func serveBlob(w http.ResponseWriter, req *http.Request, records []*imageRecord, digest string) {
+	for _, r := range records {
+		digests, err := r.blobs()
+		if err != nil {
+			continue
+		}
+		for _, d := range digests {
+			if d == digest {
+				serveBlobFile(w, req, digest, "application/octet-stream")
+				return
+			}
+		}
+	}
+	registryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+}
+
+// serveBlobFile serves blob digest of the blob store with contentType, supports range requests
+func serveBlobFile(w http.ResponseWriter, req *http.Request, digest, contentType string) {
+	path, err := blobPath(digest)
+	if err != nil {
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		registryError(w, http.StatusNotFound, "BLOB_UNKNOWN", errors.Wrap(err, "blob missing from the store").Error())
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Etag", `"`+digest+`"`)
+	http.ServeContent(w, req, strings.TrimPrefix(digest, "sha256:"), info.ModTime(), f)
+}
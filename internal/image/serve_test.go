@@ -0,0 +1,155 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestServeRegistry(t *testing.T) {
+	defer useTempStore(t)()
+	server := httptest.NewServer(registryHandler{})
+	defer server.Close()
+
+	alpine, alpineManifest := storeImage(t, "alpine:3.12", []byte("alpine layer"))
+	storeImage(t, "alpine:edge", []byte("edge layer"))
+	app, appManifest := storeImage(t, "registry.example.com/team/app:v1", []byte("app layer"))
+	alpineData, appData := storedBlob(t, alpine.ManifestDigest), storedBlob(t, app.ManifestDigest)
+
+	tests := []struct {
+		method, path string
+		status       int
+		body         string // expected body, or error code of the registry
+		digest       string
+	}{
+		{"GET", "/v2/", http.StatusOK, "", ""},
+		{"GET", "/v2/library/alpine/manifests/3.12", http.StatusOK, string(alpineData), alpine.ManifestDigest},
+		{"HEAD", "/v2/library/alpine/manifests/3.12", http.StatusOK, "", alpine.ManifestDigest},
+		{"GET", "/v2/library/alpine/manifests/" + alpine.ManifestDigest, http.StatusOK, string(alpineData), alpine.ManifestDigest},
+		{"GET", "/v2/library/alpine/manifests/latest", http.StatusNotFound, "MANIFEST_UNKNOWN", ""},
+		{"GET", "/v2/library/alpine/blobs/" + alpineManifest.Layers[0].Digest, http.StatusOK, "alpine layer", alpineManifest.Layers[0].Digest},
+		{"GET", "/v2/library/alpine/blobs/" + appManifest.Layers[0].Digest, http.StatusNotFound, "BLOB_UNKNOWN", ""},
+		{"GET", "/v2/library/alpine/blobs/sha256:abc", http.StatusNotFound, "BLOB_UNKNOWN", ""},
+		{"GET", "/v2/library/alpine/tags/list", http.StatusOK, `{"name":"library/alpine","tags":["3.12","edge"]}`, ""},
+		{"GET", "/v2/registry.example.com/team/app/manifests/v1", http.StatusOK, string(appData), app.ManifestDigest},
+		{"GET", "/v2/registry.example.com/team/app/blobs/" + appManifest.Layers[0].Digest, http.StatusOK, "app layer", appManifest.Layers[0].Digest},
+		{"GET", "/v2/team/app/manifests/v1", http.StatusNotFound, "NAME_UNKNOWN", ""},
+		{"GET", "/v2/library/alpine/tags/3.12", http.StatusNotFound, "NOT_FOUND", ""},
+		{"PUT", "/v2/library/alpine/manifests/3.12", http.StatusMethodNotAllowed, "UNSUPPORTED", ""},
+		{"POST", "/v2/library/alpine/blobs/uploads/", http.StatusMethodNotAllowed, "UNSUPPORTED", ""},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s: status %d, want %d", test.method, test.path, resp.StatusCode, test.status)
+			continue
+		}
+		if got := resp.Header.Get("Docker-Content-Digest"); got != test.digest {
+			t.Errorf("%s %s: digest %q, want %q", test.method, test.path, got, test.digest)
+		}
+		if test.status == http.StatusOK {
+			if got := strings.TrimSpace(string(body)); got != test.body {
+				t.Errorf("%s %s: body %q, want %q", test.method, test.path, got, test.body)
+			}
+			continue
+		}
+		var registryErr struct {
+			Errors []struct{ Code string } `json:"errors"`
+		}
+		if err := json.Unmarshal(body, &registryErr); err != nil || len(registryErr.Errors) != 1 || registryErr.Errors[0].Code != test.body {
+			t.Errorf("%s %s: body %s, want error %s", test.method, test.path, body, test.body)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/v2/library/alpine/blobs/"+alpineManifest.Layers[0].Digest, nil)
+	req.Header.Set("Range", "bytes=7-")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "layer" {
+		t.Errorf("range request: status %d, body %q, want %d, %q", resp.StatusCode, body, http.StatusPartialContent, "layer")
+	}
+}
+
+func TestServeRegistryMirror(t *testing.T) {
+	defer useTempStore(t)()
+	mirror := httptest.NewServer(registryHandler{})
+	defer mirror.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/team/app/manifests/v2" {
+			w.Write([]byte("upstream"))
+		} else if r.URL.Path != "/v2/" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+	mirrorHost, upstreamHost := strings.TrimPrefix(mirror.URL, "http://"), strings.TrimPrefix(upstream.URL, "http://")
+
+	served, _ := storeImage(t, "team/app:v1", []byte("layer"))
+	servedData := storedBlob(t, served.ManifestDigest)
+	viper.Set("registry-mirror", []string{upstreamHost + "=127.0.0.1:1", upstreamHost + "=" + mirrorHost, "docker.io=127.0.0.1:1"})
+	defer viper.Set("registry-mirror", nil)
+
+	var warnings []string
+	ref, err := ParseReference(upstreamHost + "/team/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newPullClient(ref, func(msg string) { warnings = append(warnings, msg) })
+	if err != nil {
+		t.Fatalf("newPullClient failed: %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		body     string
+		warnings []string // mirrors warned about
+	}{
+		// the first mirror is down, the image is served by the second
+		{"manifests/v1", string(servedData), []string{"127.0.0.1:1"}},
+		// the second mirror doesn't have the image, the registry does
+		{"manifests/v2", "upstream", []string{mirrorHost}},
+	}
+	for _, test := range tests {
+		resp, err := c.get(context.Background(), test.path, nil)
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != test.body {
+			t.Errorf("%s: body %q, want %q", test.path, body, test.body)
+		}
+		var mirrors []string
+		for _, w := range warnings {
+			mirrors = append(mirrors, strings.Fields(w)[1])
+		}
+		if !reflect.DeepEqual(mirrors, test.warnings) {
+			t.Errorf("%s: warnings %q, want warnings about %v", test.path, warnings, test.warnings)
+		}
+		warnings = nil
+	}
+	if _, err := c.get(context.Background(), "manifests/v3", nil); err == nil {
+		t.Error("request for a manifest neither the mirrors nor the registry have succeeded")
+	}
+}
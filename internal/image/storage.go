@@ -0,0 +1,236 @@
+package image
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/amit-yuval/locker/internal/archive"
+
+	"github.com/pkg/errors"
+)
+
+// digestHex returns the hex part of a sha256 digest, validating it can be used as a file name
+func digestHex(digest string) (string, error) {
+	if !digestRegexp.MatchString(digest) {
+		return "", errors.Errorf("invalid digest %q", digest)
+	}
+	return strings.TrimPrefix(digest, "sha256:"), nil
+}
+
+// blobPath returns the path of a blob in the blob store, by its content digest
+func blobPath(digest string) (string, error) {
+	hex, err := digestHex(digest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(blobsDir, hex), nil
+}
+
+// layerPath returns the directory of an unpacked layer in the layer store, by its diff ID
+func layerPath(diffID string) (string, error) {
+	hex, err := digestHex(diffID)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(layersDir, hex), nil
+}
+
+// legacyLayerPath returns the directory of a layer with diffID migrated from older versions of locker
+// their extraction lost ownership, extended attributes and whiteouts, so pulls don't reuse them and unpack the layer again
+func legacyLayerPath(diffID string) (string, error) {
+	hex, err := digestHex(diffID)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(layersDir, "legacy-"+hex), nil
+}
+
+// writeBlob stores content of r in the blob store under the digest of desc, returns path of the blob
+// the content is verified against the digest and size of desc before it is stored
+func writeBlob(desc descriptor, r io.Reader) (string, error) {
+	digest := desc.Digest
+	path, err := blobPath(digest)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(blobsDir, 0744); err != nil {
+		return "", errors.Wrap(err, "couldn't create blobs directory")
+	}
+	tmpFile, err := ioutil.TempFile(blobsDir, ".tmp-")
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't create blob file")
+	}
+	defer os.Remove(tmpFile.Name())
+	v := newVerifier(r, digest, desc.Size)
+	_, err = io.Copy(tmpFile, v)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't write blob %s", digest)
+	}
+	if err := v.verify(); err != nil {
+		return "", errors.Wrapf(err, "blob %s is corrupted", digest)
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return "", errors.Wrapf(err, "couldn't store blob %s", digest)
+	}
+	return path, nil
+}
+
+// unpackLayer extracts layer blob, compressed according to mediaType, into the layer store under diffID,
+// returns the layer directory
+// the layer is extracted to a temporary directory first, so a layer directory is always complete,
+// and is stored only if the uncompressed content matches diffID
+func unpackLayer(blob, mediaType, diffID string) (string, error) {
+	layerDir, err := layerPath(diffID)
+	if err != nil {
+		return "", err
+	}
+	c, err := layerCompression(mediaType)
+	if err != nil {
+		return "", err
+	}
+	blobFile, err := os.Open(blob)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't open layer blob")
+	}
+	defer blobFile.Close()
+
+	if err := os.MkdirAll(layersDir, 0744); err != nil {
+		return "", errors.Wrap(err, "couldn't create layers directory")
+	}
+	tmpDir, err := ioutil.TempDir(layersDir, ".tmp-")
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't create layer directory")
+	}
+	defer os.RemoveAll(tmpDir)
+	// the layer may set permissions of its root directory
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return "", errors.Wrap(err, "couldn't set layer directory permissions")
+	}
+	tarReader, err := decompress(c, blobFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't decompress layer %s", diffID)
+	}
+	defer tarReader.Close()
+	v := newVerifier(tarReader, diffID, -1)
+	if err := archive.Apply(tmpDir, v); err != nil {
+		return "", errors.Wrapf(err, "error extracting layer %s", diffID)
+	}
+	// hash the end of archive padding as well
+	if _, err := io.Copy(ioutil.Discard, v); err != nil {
+		return "", errors.Wrapf(err, "couldn't decompress layer %s", diffID)
+	}
+	if err := tarReader.Close(); err != nil {
+		return "", err
+	}
+	if err := v.verify(); err != nil {
+		return "", errors.Wrapf(err, "layer %s is corrupted", diffID)
+	}
+	if err := os.Rename(tmpDir, layerDir); err != nil {
+		// layer was unpacked concurrently by another pull
+		if _, statErr := os.Stat(layerDir); statErr != nil {
+			return "", errors.Wrapf(err, "couldn't store layer %s", diffID)
+		}
+	}
+	return layerDir, nil
+}
+
+// collectGarbage removes layers and blobs of the store that no image, nor its build cache, uses
+// it takes the pull lock exclusively, so layers and blobs pulls, loads and builds create before they record them are kept
+func collectGarbage() error {
+	unlockPulls, err := lockPulls(true)
+	if err != nil {
+		return err
+	}
+	defer unlockPulls()
+	return updateStore(func(s *imageStore) error {
+		if err := removeUnusedLayers(s); err != nil {
+			return err
+		}
+		return removeUnusedBlobs(s)
+	})
+}
+
+// removeUnusedLayers deletes layers of the layer store that no image of s, nor its build cache, uses
+func removeUnusedLayers(s *imageStore) error {
+	counts := s.layerRefCounts()
+	for _, entry := range s.BuildCache {
+		if layerDir, err := layerPath(entry.DiffID); err == nil {
+			counts[layerDir]++
+		}
+	}
+	entries, err := ioutil.ReadDir(layersDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "couldn't read layers directory")
+	}
+	for _, entry := range entries {
+		layerDir := filepath.Join(layersDir, entry.Name())
+		if strings.HasPrefix(entry.Name(), ".") || counts[layerDir] > 0 {
+			continue
+		}
+		if err := os.RemoveAll(layerDir); err != nil {
+			return errors.Wrapf(err, "couldn't remove layer %s", entry.Name())
+		}
+	}
+	return nil
+}
+
+// removeUnusedBlobs deletes blobs of the blob store that no image of s, nor its build cache, references
+func removeUnusedBlobs(s *imageStore) error {
+	used, err := s.usedBlobs()
+	if err != nil {
+		return err
+	}
+	for _, entry := range s.BuildCache {
+		used[strings.TrimPrefix(entry.Layer.Digest, "sha256:")] = true
+	}
+	entries, err := ioutil.ReadDir(blobsDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "couldn't read blobs directory")
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || used[entry.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(blobsDir, entry.Name())); err != nil {
+			return errors.Wrapf(err, "couldn't remove blob %s", entry.Name())
+		}
+	}
+	return nil
+}
+
+// removeCreated removes layers and blobs created by a failed pull, unless an image pulled concurrently uses them
+func removeCreated(created []string) error {
+	unlock, err := lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s, err := readStoreFile()
+	if os.IsNotExist(err) {
+		s = newImageStore()
+	} else if err != nil {
+		return err
+	}
+	counts := s.layerRefCounts()
+	used, err := s.usedBlobs()
+	if err != nil {
+		return err
+	}
+	for _, path := range created {
+		if counts[path] > 0 || (filepath.Dir(path) == filepath.Clean(blobsDir) && used[filepath.Base(path)]) {
+			continue
+		}
+		os.RemoveAll(path)
+	}
+	return nil
+}
@@ -0,0 +1,488 @@
+package image
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/amit-yuval/locker/internal/utils"
+
+	"github.com/alexflint/go-filemutex"
+	"github.com/pkg/errors"
+)
+
+// storeVersion is the version of the image store format
+const storeVersion = 1
+
+// imageRecord is the metadata of a local image
+type imageRecord struct {
+	Registry       string    `json:"registry"`
+	Repository     string    `json:"repository"`
+	Tag            string    `json:"tag,omitempty"`
+	Digest         string    `json:"digest,omitempty"`         // digest the image was pulled by, of its manifest or manifest list
+	ManifestDigest string    `json:"manifestDigest,omitempty"` // digest of the image manifest, empty for images pulled before manifests were stored
+	ConfigDigest   string    `json:"configDigest"`
+	DiffIDs        []string  `json:"diffIDs"`
+	Platform       string    `json:"platform,omitempty"`
+	Created        time.Time `json:"created"` // creation time of the image, from its config
+	Size           int64     `json:"size"`    // size of the unpacked layers
+	Pulled         time.Time `json:"pulled"`
+	LastUsed       time.Time `json:"lastUsed,omitempty"` // last time a container was run from the image
+	Legacy         bool      `json:"legacy,omitempty"`   // layers were extracted by older versions of locker, and stored apart
+	Local          bool      `json:"local,omitempty"`    // built, imported, committed, loaded or tagged, not pulled by its reference
+	Outdated       bool      `json:"outdated,omitempty"` // replaced by a newer image of its tag, kept for the containers using it
+}
+
+// buildCacheEntry is the layer a RUN instruction of a build created
+type buildCacheEntry struct {
+	DiffID  string     `json:"diffID"`
+	Layer   descriptor `json:"layer"`
+	Created time.Time  `json:"created"`
+}
+
+// imageStore is the database of local images, keyed by reference
+type imageStore struct {
+	Version    int                         `json:"version"`
+	Images     map[string]*imageRecord     `json:"images"`
+	BuildCache map[string]*buildCacheEntry `json:"buildCache,omitempty"` // keyed by the cache key of the instruction
+}
+
+// newImageStore returns an empty image store
+func newImageStore() *imageStore {
+	return &imageStore{Version: storeVersion, Images: make(map[string]*imageRecord)}
+}
+
+// layerDirs returns the layer directories of the image, ordered from the base layer up
+func (r *imageRecord) layerDirs() ([]string, error) {
+	dirs := make([]string, 0, len(r.DiffIDs))
+	for _, diffID := range r.DiffIDs {
+		dir, err := layerPath(diffID)
+		if r.Legacy {
+			dir, err = legacyLayerPath(diffID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// lastUsed returns the last time the image was run, or pulled if it never ran
+func (r *imageRecord) lastUsed() time.Time {
+	if r.LastUsed.After(r.Pulled) {
+		return r.LastUsed
+	}
+	return r.Pulled
+}
+
+// blobs returns digests of the blobs of the image: manifest, config and compressed layers
+func (r *imageRecord) blobs() ([]string, error) {
+	digests := []string{r.ConfigDigest}
+	if r.ManifestDigest == "" {
+		return digests, nil
+	}
+	m, err := readManifestBlob(r.ManifestDigest)
+	if err != nil {
+		return nil, err
+	}
+	digests = append(digests, r.ManifestDigest)
+	for _, layer := range m.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	return digests, nil
+}
+
+// get returns the record of ref, and whether it exists
+func (s *imageStore) get(ref *Reference) (*imageRecord, bool) {
+	r, ok := s.Images[ref.String()]
+	return r, ok
+}
+
+// names returns the sorted references of the images in the store
+func (s *imageStore) names() []string {
+	names := make([]string, 0, len(s.Images))
+	for name := range s.Images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// imageID returns the ID of the image of the record, the digest of its config, shared by all of its references
+func (r *imageRecord) imageID() string {
+	return r.ConfigDigest
+}
+
+// layerRefCounts returns the number of images using each layer directory, references of the same image count once
+func (s *imageStore) layerRefCounts() map[string]int {
+	counts := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, r := range s.Images {
+		if seen[r.imageID()] {
+			continue
+		}
+		seen[r.imageID()] = true
+		dirs, err := r.layerDirs()
+		if err != nil {
+			continue
+		}
+		for _, dir := range dirs {
+			counts[dir]++
+		}
+	}
+	return counts
+}
+
+// usedBlobs returns the hex digests of the blobs used by images of the store
+func (s *imageStore) usedBlobs() (map[string]bool, error) {
+	used := make(map[string]bool)
+	for _, r := range s.Images {
+		digests, err := r.blobs()
+		if err != nil {
+			return nil, err
+		}
+		for _, digest := range digests {
+			used[strings.TrimPrefix(digest, "sha256:")] = true
+		}
+	}
+	return used, nil
+}
+
+// references returns the references of the image with ID id, sorted
+func (s *imageStore) references(id string) []string {
+	var refs []string
+	for _, name := range s.names() {
+		if s.Images[name].imageID() == id {
+			refs = append(refs, name)
+		}
+	}
+	return refs
+}
+
+// readStore returns the image store, creates it on first use
+func readStore() (*imageStore, error) {
+	s, err := readStoreFile()
+	if os.IsNotExist(err) {
+		if err := updateStore(func(*imageStore) error { return nil }); err != nil {
+			return nil, err
+		}
+		return readStoreFile()
+	}
+	return s, err
+}
+
+// recordImage adds image ref, whose layers are unpacked to layerList, to the image store, local if it wasn't pulled by ref
+// an image stored by the same reference is replaced, an image pulled concurrently by it has the same content
+func recordImage(ref *Reference, refDigest, manifestDigest string, m *manifest, imageConfig *imageConfigFile, layerList []string, local bool) error {
+	var size int64
+	for _, layerDir := range layerList {
+		layerSize, err := utils.DirSize(layerDir)
+		if err != nil {
+			return errors.Wrap(err, "couldn't get disk usage of directory")
+		}
+		size += layerSize
+	}
+	record := &imageRecord{
+		Registry:       ref.Registry,
+		Repository:     ref.Repository,
+		Tag:            ref.Tag,
+		Digest:         refDigest,
+		ManifestDigest: manifestDigest,
+		ConfigDigest:   m.Config.Digest,
+		DiffIDs:        imageConfig.RootFS.DiffIDs,
+		Platform:       imageConfig.platform.normalize().String(),
+		Created:        imageConfig.Created,
+		Size:           size,
+		Pulled:         time.Now().UTC(),
+		Local:          local,
+	}
+	used, err := containerImages()
+	if err != nil {
+		return err
+	}
+	return updateStore(func(s *imageStore) error {
+		s.keepOutdated(ref.String(), record.imageID(), used)
+		s.Images[ref.String()] = record
+		return nil
+	})
+}
+
+// keepOutdated keeps the image stored by name, about to be replaced by image id, by the digest of its manifest,
+// if containers use it and no other reference does, so they keep working on its layers until they are pruned
+// used holds the manifest digests of the images of containers
+func (s *imageStore) keepOutdated(name, id string, used map[string]bool) {
+	r, ok := s.Images[name]
+	if !ok || r.Tag == "" || r.imageID() == id || !used[r.ManifestDigest] || len(s.references(r.imageID())) > 1 {
+		return
+	}
+	outdated := *r
+	outdated.Tag, outdated.Outdated = "", true
+	ref := &Reference{Registry: r.Registry, Repository: r.Repository, Digest: r.ManifestDigest}
+	s.Images[ref.String()] = &outdated
+}
+
+// lockStore takes the image store lock, returns a function releasing it
+func lockStore() (func(), error) {
+	if err := os.MkdirAll(imagesDir, 0744); err != nil {
+		return nil, errors.Wrap(err, "couldn't create images directory")
+	}
+	m, err := filemutex.New(storeLockFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't open lock %v", storeLockFile)
+	}
+	if err := m.Lock(); err != nil {
+		m.Close()
+		return nil, errors.Wrapf(err, "couldn't take lock %v", storeLockFile)
+	}
+	return func() { m.Unlock(); m.Close() }, nil
+}
+
+// lockPulls takes the pull lock, returns a function releasing it
+// pulls share the lock while they create layers and blobs not yet recorded in the store,
+// garbage collection takes it exclusively so it doesn't remove them
+func lockPulls(exclusive bool) (func(), error) {
+	if err := os.MkdirAll(imagesDir, 0744); err != nil {
+		return nil, errors.Wrap(err, "couldn't create images directory")
+	}
+	m, err := filemutex.New(pullLockFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't open lock %v", pullLockFile)
+	}
+	if exclusive {
+		err = m.Lock()
+	} else {
+		err = m.RLock()
+	}
+	if err != nil {
+		m.Close()
+		return nil, errors.Wrapf(err, "couldn't take lock %v", pullLockFile)
+	}
+	if exclusive {
+		return func() { m.Unlock(); m.Close() }, nil
+	}
+	return func() { m.RUnlock(); m.Close() }, nil
+}
+
+// updateStore calls fn with the image store while holding the store lock, writes the store back if fn succeeds
+// the store is created on first use, migrating images pulled by older versions of locker
+func updateStore(fn func(s *imageStore) error) error {
+	unlock, err := lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := readStoreFile()
+	if os.IsNotExist(err) {
+		s, err = migrateImagesJson()
+	}
+	if err != nil {
+		return err
+	}
+	if err := fn(s); err != nil {
+		return err
+	}
+	return writeStoreFile(s)
+}
+
+// readStoreFile reads the image store file, returns the os error if it doesn't exist
+func readStoreFile() (*imageStore, error) {
+	data, err := ioutil.ReadFile(storeFile)
+	if os.IsNotExist(err) {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Wrap(err, "couldn't read image store")
+	}
+	s := newImageStore()
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse image store")
+	}
+	if s.Version > storeVersion {
+		return nil, errors.Errorf("image store version %d is newer than supported version %d", s.Version, storeVersion)
+	}
+	if s.Images == nil {
+		s.Images = make(map[string]*imageRecord)
+	}
+	return s, nil
+}
+
+// writeStoreFile atomically replaces the image store file with s
+func writeStoreFile(s *imageStore) error {
+	s.Version = storeVersion
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal image store")
+	}
+	tmpFile, err := ioutil.TempFile(imagesDir, ".imagedb-")
+	if err != nil {
+		return errors.Wrap(err, "couldn't write image store")
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Chmod(0644)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "couldn't write image store")
+	}
+	if err := os.Rename(tmpFile.Name(), storeFile); err != nil {
+		return errors.Wrap(err, "couldn't write image store")
+	}
+	return nil
+}
+
+// readManifestBlob reads an image manifest from the blob store
+func readManifestBlob(digest string) (*manifest, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read manifest %s", digest)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse manifest %s", digest)
+	}
+	return &m, nil
+}
+
+// readConfigBlob reads the config of an image from the blob store
+func readConfigBlob(digest string) ([]byte, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read image config %s", digest)
+	}
+	return data, nil
+}
+
+// migrateImagesJson creates the image store from the images.json file of older versions of locker
+// configs and manifests of images move to the blob store, layers extracted into image directories move to the layer store
+// apart from the layers locker unpacks, images.json is removed once the store is written
+func migrateImagesJson() (*imageStore, error) {
+	s := newImageStore()
+	data, err := ioutil.ReadFile(imagesJsonFile)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "couldn't read images json file")
+	}
+	imagesMap := make(map[string][]string)
+	if err := json.Unmarshal(data, &imagesMap); err != nil {
+		return nil, errors.Wrap(err, "couldn't load images map from json file")
+	}
+	for name, layerList := range imagesMap {
+		ref, err := ParseReference(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't migrate image %s", name)
+		}
+		r, err := migrateImage(ref, layerList)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't migrate image %s", name)
+		}
+		s.Images[ref.String()] = r
+	}
+	if err := writeStoreFile(s); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(imagesJsonFile); err != nil {
+		return nil, errors.Wrap(err, "couldn't remove images json file")
+	}
+	return s, nil
+}
+
+// migrateImage creates the record of an image stored by older versions of locker in its own directory
+func migrateImage(ref *Reference, layerList []string) (*imageRecord, error) {
+	imageDir := ref.path()
+	for _, layer := range layerList {
+		if filepath.Dir(layer) != filepath.Clean(layersDir) {
+			// layers were extracted into the image directory
+			imageDir = filepath.Dir(layer)
+			break
+		}
+	}
+	confData, err := ioutil.ReadFile(filepath.Join(imageDir, configFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't read image config")
+	}
+	var imageConfig imageConfigFile
+	if err := json.Unmarshal(confData, &imageConfig); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse image config")
+	}
+	diffIDs := imageConfig.RootFS.DiffIDs
+	if len(diffIDs) != len(layerList) {
+		return nil, errors.New("image config doesn't match image layers")
+	}
+	r := &imageRecord{
+		Registry:     ref.Registry,
+		Repository:   ref.Repository,
+		Tag:          ref.Tag,
+		Digest:       ref.Digest,
+		ConfigDigest: digestBytes(confData),
+		DiffIDs:      diffIDs,
+		Platform:     imageConfig.platform.normalize().String(),
+		Created:      imageConfig.Created,
+		Legacy:       true,
+	}
+	var created []string
+	if err := createBlob(descriptor{Digest: r.ConfigDigest, Size: int64(len(confData))}, confData, &created); err != nil {
+		return nil, err
+	}
+	if manifestData, err := ioutil.ReadFile(filepath.Join(imageDir, manifestFile)); err == nil {
+		r.ManifestDigest = digestBytes(manifestData)
+		if err := createBlob(descriptor{Digest: r.ManifestDigest, Size: int64(len(manifestData))}, manifestData, &created); err != nil {
+			return nil, err
+		}
+	}
+	if info, err := os.Stat(filepath.Join(imageDir, configFile)); err == nil {
+		r.Pulled = info.ModTime()
+	}
+
+	for i, layer := range layerList {
+		layerDir, err := legacyLayerPath(diffIDs[i])
+		if err != nil {
+			return nil, err
+		}
+		if layer != layerDir {
+			if err := os.MkdirAll(layersDir, 0744); err != nil {
+				return nil, errors.Wrap(err, "couldn't create layers directory")
+			}
+			if _, err := os.Stat(layerDir); os.IsNotExist(err) {
+				if err := os.Rename(layer, layerDir); err != nil {
+					return nil, errors.Wrapf(err, "couldn't move layer %s", diffIDs[i])
+				}
+			} else if err := os.RemoveAll(layer); err != nil {
+				return nil, errors.Wrapf(err, "couldn't remove layer %s", layer)
+			}
+		}
+		size, err := utils.DirSize(layerDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't get disk usage of directory")
+		}
+		r.Size += size
+	}
+
+	for _, name := range []string{configFile, manifestFile, platformFile} {
+		os.Remove(filepath.Join(imageDir, name))
+	}
+	// directories of containers still running from the image are kept
+	for dir := imageDir; dir != filepath.Clean(imagesDir); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,44 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	lockerio "gitlab.com/amit-yuval/locker/pkg/io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// MountVolumes mounts an anonymous volume at each of the paths of the container,
+// a volume starts with the content of the image at its path, and is removed with the container
+func (c *ImageConfig) MountVolumes(paths []string) error {
+	mergedDir := filepath.Join(c.Dir, Merged)
+	for i, path := range paths {
+		// symlinks of the image are resolved inside the container, so a volume is never mounted over a host path
+		target, err := lockerio.ScopedResolve(mergedDir, path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return errors.Wrapf(err, "couldn't create volume mount point %s", path)
+		}
+		if fi, err := os.Lstat(target); err != nil || !fi.IsDir() {
+			return errors.Errorf("volume mount point %s is not a directory", path)
+		}
+		source := filepath.Join(c.Dir, volumesDir, fmt.Sprint(i))
+		if err := os.MkdirAll(source, 0755); err != nil {
+			return errors.Wrapf(err, "couldn't create volume %s", path)
+		}
+		// copy content and ownership of the image directory into the volume
+		if _, err := lockerio.CmdOut("cp", "-a", target+"/.", source); err != nil {
+			return errors.Wrapf(err, "couldn't initialize volume %s", path)
+		}
+		if err := unix.Mount(source, target, "", unix.MS_BIND, ""); err != nil {
+			return errors.Wrapf(err, "couldn't mount volume %s", path)
+		}
+		c.volumes = append(c.volumes, target)
+	}
+	return nil
+}
@@ -1,11 +1,14 @@
 package mount
 
 import (
+	"bufio"
 	"os"
+	"strconv"
 	"strings"
 
 	"gitlab.com/amit-yuval/locker/pkg/io"
 
+	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
 
@@ -147,3 +150,46 @@ func parseOptions(options []string) (int, string) {
 	}
 	return flag, strings.Join(data, ",")
 }
+
+// MountPoints returns the mount points of the current mount namespace under dir, in mount order
+// mount points whose directory was deleted are included
+func MountPoints(dir string) ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't read mount table")
+	}
+	defer f.Close()
+	dir = strings.TrimSuffix(dir, "/")
+	var points []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		point := strings.TrimSuffix(unescapeMountPath(fields[4]), " (deleted)")
+		if strings.HasPrefix(point, dir+"/") {
+			points = append(points, point)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "couldn't read mount table")
+	}
+	return points, nil
+}
+
+// unescapeMountPath decodes the octal escapes of whitespace and backslashes in paths of the mount table
+func unescapeMountPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
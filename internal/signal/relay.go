@@ -0,0 +1,52 @@
+package signal
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Parse parses a signal by name (SIGTERM or TERM) or number
+func Parse(s string) (unix.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, errors.Errorf("invalid signal number %d", n)
+		}
+		return unix.Signal(n), nil
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return 0, errors.Errorf("invalid signal %s", s)
+	}
+	return sig, nil
+}
+
+// Relay sends sig to the process returned by target whenever one of the given signals is received,
+// returns a function that stops relaying
+func Relay(target func() int, sig unix.Signal, on ...os.Signal) func() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, on...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-c:
+				unix.Kill(target(), sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -12,6 +13,7 @@ import (
 
 	uuid "github.com/nu7hatch/gouuid"
 	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
 )
 
 func init() {
@@ -67,40 +69,24 @@ func GetExecutablePath(executable, baseDir string, envList []string) (string, er
 	return "", errors.Errorf("couldn't find executable %s", executable)
 }
 
-// InterfaceArrToStrArr gets interface array and return string array
-func InterfaceArrToStrArr(arr []interface{}) []string {
-	ret := make([]string, len(arr))
-	for i, v := range arr {
-		ret[i] = v.(string)
-	}
-	return ret
-}
-
-// GetChildArgs gets arguments to pass to child process
-// imageName - name of image to run, mergedDir - mount point of image, cmdList - command to run
-func GetChildArgs(imageName, mergedDir string, cmdList []string) []string {
-	ret := os.Args[1:]                  //remove "locker"
-	ret = deleteElement("run", ret)     //remove "run"
-	ret = deleteElement(imageName, ret) //remove image name
-	ret = append(ret, mergedDir)        //add merged dir
-	ret = append(ret, cmdList...)       //add cmdList
-	return ret
-}
-
-// deleteElement deletes given element from list, expects item to exist
-func deleteElement(element string, a []string) []string {
-	i := findElement(element, a)
-	return append(a[:i], a[i+1:]...)
-}
-
-// findElement return index of element if exists, -1 if doesnt
-func findElement(element string, arr []string) int {
-	for i := range arr {
-		if arr[i] == element {
-			return i
+// GetChildArgs gets arguments to pass to child process, the flags set for locker, followed by the container arguments
+// mergedDir - mount point of image, cmdList - command to run
+func GetChildArgs(mergedDir string, cmdList []string) []string {
+	var ret []string
+	pflag.VisitAll(func(f *pflag.Flag) {
+		if !f.Changed {
+			return
 		}
-	}
-	return -1
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			for _, v := range slice.GetSlice() {
+				ret = append(ret, fmt.Sprintf("--%s=%s", f.Name, v))
+			}
+			return
+		}
+		ret = append(ret, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+	})
+	ret = append(ret, "--", mergedDir) //end of flags, add merged dir
+	return append(ret, cmdList...)     //add cmdList
 }
 
 type createFunc func(length int) (string, error)
@@ -153,7 +139,7 @@ func DirSize(path string) (int64, error) {
 func Pad(length int, char string, list ...string) string {
 	var ret string
 	for _, v := range list {
-		ret += v + strings.Repeat(" ", length-len(v))
+		ret += v + strings.Repeat(char, Max(length-len(v), 1))
 	}
 	return ret
 }
@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 // CmdOut runs command and return output as string
@@ -127,3 +128,98 @@ func WriteToFile(fileName string, flag int, text string) error {
 	}
 	return nil
 }
+
+// ReadPassword reads a line from given terminal without echoing it
+func ReadPassword(fd int) (string, error) {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't get terminal attributes")
+	}
+	noEcho := *termios
+	noEcho.Lflag &^= unix.ECHO
+	noEcho.Lflag |= unix.ICANON | unix.ISIG
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho); err != nil {
+		return "", errors.Wrap(err, "couldn't disable terminal echo")
+	}
+	defer unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+
+	line, err := bufio.NewReader(os.NewFile(uintptr(fd), "")).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// IsTerminal returns true if given file descriptor is a terminal
+func IsTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	return err == nil
+}
+
+// ScopedJoin joins name to root, resolving symlinks of its parent directories as if root was the file system root,
+// so the returned path is always beneath root
+// the last element of name is not resolved
+func ScopedJoin(root, name string) (string, error) {
+	parent, base := filepath.Split(filepath.Clean("/" + name))
+	dir, err := resolveScoped(root, parent)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't resolve %s", name)
+	}
+	return filepath.Join(dir, base), nil
+}
+
+// ScopedResolve joins name to root like ScopedJoin, resolving the last element of name as well,
+// so the returned path is never a symlink, and is beneath root
+func ScopedResolve(root, name string) (string, error) {
+	p, err := resolveScoped(root, filepath.Clean("/"+name))
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't resolve %s", name)
+	}
+	return p, nil
+}
+
+// resolveScoped resolves path beneath root, treating root as the file system root for symlinks and ".."
+func resolveScoped(root, path string) (string, error) {
+	current := "/"
+	remaining := path
+	links := 0
+	for remaining != "" {
+		var component string
+		if i := strings.IndexByte(remaining, '/'); i == -1 {
+			component, remaining = remaining, ""
+		} else {
+			component, remaining = remaining[:i], remaining[i+1:]
+		}
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+		next := filepath.Join(current, component)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) {
+			current = next
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", errors.Errorf("too many levels of symbolic links in %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			current = "/"
+		}
+		remaining = target + "/" + remaining
+	}
+	return filepath.Join(root, current), nil
+}
@@ -0,0 +1,109 @@
+package io
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScopedJoin(t *testing.T) {
+	root, err := ioutil.TempDir("", "scoped-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, dir := range []string{"usr/lib", "etc"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"abs":      "/etc",
+		"up":       "../../..",
+		"lib":      "usr/lib",
+		"usr/self": "../usr",
+		"loop":     "loop",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"etc/passwd", "etc/passwd"},
+		{"/etc/passwd", "etc/passwd"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"usr/../../../etc/passwd", "etc/passwd"},
+		{"abs/passwd", "etc/passwd"},
+		{"up/etc/passwd", "etc/passwd"},
+		{"up/../../tmp/x", "tmp/x"},
+		{"lib/x.so", "usr/lib/x.so"},
+		{"usr/self/self/lib", "usr/lib"},
+		// the last element isn't resolved, so a symlink can be replaced rather than written through
+		{"abs", "abs"},
+		{"up", "up"},
+	}
+	for _, test := range tests {
+		got, err := ScopedJoin(root, test.name)
+		if err != nil {
+			t.Errorf("ScopedJoin(%q) failed: %v", test.name, err)
+			continue
+		}
+		if want := filepath.Join(root, test.want); got != want {
+			t.Errorf("ScopedJoin(%q) = %q, want %q", test.name, got, want)
+		}
+	}
+
+	if got, err := ScopedJoin(root, "loop/x"); err == nil {
+		t.Errorf("ScopedJoin of a symlink loop = %q, want an error", got)
+	}
+}
+
+func TestScopedResolve(t *testing.T) {
+	root, err := ioutil.TempDir("", "scoped-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "var/data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"etc":      "/host/etc",
+		"up":       "../../..",
+		"data":     "var/data",
+		"var/self": ".",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"etc", "host/etc"},
+		{"/up", ""},
+		{"data", "var/data"},
+		{"var/self/self/data", "var/data"},
+		{"up/data/new", "var/data/new"},
+		{"missing", "missing"},
+	}
+	for _, test := range tests {
+		got, err := ScopedResolve(root, test.name)
+		if err != nil {
+			t.Errorf("ScopedResolve(%q) failed: %v", test.name, err)
+			continue
+		}
+		if want := filepath.Join(root, test.want); got != want {
+			t.Errorf("ScopedResolve(%q) = %q, want %q", test.name, got, want)
+		}
+	}
+}